@@ -0,0 +1,80 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BALANCER_ROUND_ROBIN = "round_robin"
+	BALANCER_RANDOM      = "random"
+)
+
+// Balancer 从候选的从库中选一个执行读查询
+// 每个sql instance创建一个Balancer，Pick会被并发调用
+type Balancer interface {
+	// addrs不为空，返回选中的下标，越界时使用主库
+	Pick(addrs []string) int
+}
+
+var (
+	balancersMu sync.RWMutex
+	balancers   = make(map[string]func() Balancer)
+)
+
+func init() {
+	RegisterBalancer(BALANCER_ROUND_ROBIN, func() Balancer { return &roundRobin{} })
+	RegisterBalancer(BALANCER_RANDOM, func() Balancer { return randomBalancer{} })
+}
+
+// RegisterBalancer 注册dbcfg中balancer可以使用的名字，重复注册或者factory为nil时panic
+func RegisterBalancer(name string, factory func() Balancer) {
+	balancersMu.Lock()
+	defer balancersMu.Unlock()
+
+	if factory == nil {
+		panic("dbrouter: RegisterBalancer factory is nil")
+	}
+
+	if er := checkVarname(name); er != nil {
+		panic(fmt.Sprintf("dbrouter: RegisterBalancer name:%s err:%s", name, er))
+	}
+
+	if _, dup := balancers[name]; dup {
+		panic("dbrouter: RegisterBalancer called twice for name " + name)
+	}
+
+	balancers[name] = factory
+}
+
+func newBalancer(name string) (Balancer, error) {
+	balancersMu.RLock()
+	defer balancersMu.RUnlock()
+
+	factory, ok := balancers[name]
+	if !ok {
+		return nil, fmt.Errorf("balancer:%s not registered", name)
+	}
+
+	return factory(), nil
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+func (m *roundRobin) Pick(addrs []string) int {
+	return int((atomic.AddUint32(&m.next, 1) - 1) % uint32(len(addrs)))
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(addrs []string) int {
+	return rand.Intn(len(addrs))
+}
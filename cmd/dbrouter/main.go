@@ -0,0 +1,179 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// dbrouter 检查和解释dbrouter的路由配置，不会连接任何数据库
+//
+//	dbrouter lint [-strict] <config>
+//	dbrouter explain <config> <cluster> <table>
+//	dbrouter matrix <config> <cluster> <tables-file>
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/shawnfeng/dbrouter"
+)
+
+const usage = `usage:
+  dbrouter lint [-strict] <config>
+        validate config, exit 1 on any error
+        -strict checks with the Strict options, e.g. unowned hash buckets are errors
+  dbrouter explain <config> <cluster> <table>
+        print the rule and instance a table resolves to
+  dbrouter matrix <config> <cluster> <tables-file>
+        print table to instance map, one table per line in tables-file
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// 执行子命令，返回进程的退出码
+func run(argv []string, stdout, stderr io.Writer) int {
+	if len(argv) < 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var err error
+	args := argv[1:]
+	switch argv[0] {
+	case "lint":
+		err = lint(stdout, args)
+	case "explain":
+		err = explain(stdout, args)
+	case "matrix":
+		err = matrix(stdout, args)
+	case "help", "-h", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		err = fmt.Errorf("unknown command:%s", argv[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(stderr, "dbrouter:", err)
+		if _, ok := err.(usageError); ok {
+			fmt.Fprint(stderr, usage)
+			return 2
+		}
+		return 1
+	}
+
+	return 0
+}
+
+type usageError string
+
+func (m usageError) Error() string {
+	return string(m)
+}
+
+func lint(w io.Writer, args []string) error {
+	// 默认和NewRouter的检查一致，-strict时和Strict模式一致
+	var opts dbrouter.Options
+	if len(args) > 0 && args[0] == "-strict" {
+		opts.Strict = true
+		args = args[1:]
+	}
+
+	if len(args) != 1 {
+		return usageError("lint need [-strict] <config>")
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	issues, err := dbrouter.ValidateConfigWithOptions(data, opts)
+	if err != nil {
+		return err
+	}
+
+	nerr := 0
+	for _, i := range issues {
+		fmt.Fprintln(w, i)
+		if i.Severity == dbrouter.SEVERITY_ERROR {
+			nerr++
+		}
+	}
+
+	if nerr > 0 {
+		return fmt.Errorf("%s: %d errors, %d warnings", args[0], nerr, len(issues)-nerr)
+	}
+
+	fmt.Fprintf(w, "%s: ok, %d warnings\n", args[0], len(issues))
+	return nil
+}
+
+func loadTable(path string) (*dbrouter.RouteTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return dbrouter.NewRouteTable(data)
+}
+
+func explain(w io.Writer, args []string) error {
+	if len(args) != 3 {
+		return usageError("explain need <config> <cluster> <table>")
+	}
+
+	rt, err := loadTable(args[0])
+	if err != nil {
+		return err
+	}
+
+	cluster, table := args[1], args[2]
+	ins := rt.Instance(cluster, table)
+	if ins == "" {
+		return fmt.Errorf("cluster:%s table:%s not routed", cluster, table)
+	}
+
+	fmt.Fprintf(w, "cluster:%s table:%s instance:%s\n", cluster, table, ins)
+	fmt.Fprintf(w, "rule:%s\n", rt.RouterInfo(cluster, table))
+	return nil
+}
+
+func matrix(w io.Writer, args []string) error {
+	if len(args) != 3 {
+		return usageError("matrix need <config> <cluster> <tables-file>")
+	}
+
+	rt, err := loadTable(args[0])
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[2])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// 没有路由到的表输出 -
+	cluster := args[1]
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		table := strings.TrimSpace(scanner.Text())
+		if table == "" || strings.HasPrefix(table, "#") {
+			continue
+		}
+
+		ins := rt.Instance(cluster, table)
+		if ins == "" {
+			ins = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", table, ins)
+	}
+
+	return scanner.Err()
+}
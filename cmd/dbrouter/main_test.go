@@ -0,0 +1,124 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+		// stderr中需要包含的内容
+		stderr string
+	}{
+		{
+			name:   "lint ok",
+			args:   []string{"lint", "testdata/router.json"},
+			code:   0,
+			stdout: "[warning] instances.unused: instance:unused not used by any cluster\ntestdata/router.json: ok, 1 warnings\n",
+		},
+		{
+			name: "lint errors",
+			args: []string{"lint", "testdata/bad.json"},
+			code: 1,
+			stdout: "[error] instances.account.dbtype: db type not support:nosuchdb\n" +
+				"[error] cluster.ACCOUNT[0].instance: in cluster:ACCOUNT instance:account not found\n",
+			stderr: "testdata/bad.json: 2 errors, 0 warnings",
+		},
+		{
+			name:   "lint unowned slots",
+			args:   []string{"lint", "testdata/unowned.json"},
+			code:   0,
+			stdout: "[warning] cluster.ACCOUNT: hash express:user buckets not owned by any instance slots:[1 2 3]\ntestdata/unowned.json: ok, 1 warnings\n",
+		},
+		{
+			name:   "lint strict unowned slots",
+			args:   []string{"lint", "-strict", "testdata/unowned.json"},
+			code:   1,
+			stdout: "[error] cluster.ACCOUNT: hash express:user buckets not owned by any instance slots:[1 2 3]\n",
+			stderr: "testdata/unowned.json: 1 errors, 0 warnings",
+		},
+		{
+			name:   "lint missing file",
+			args:   []string{"lint", "testdata/notexist.json"},
+			code:   1,
+			stderr: "notexist.json",
+		},
+		{
+			name:   "lint usage",
+			args:   []string{"lint"},
+			code:   2,
+			stderr: "lint need [-strict] <config>",
+		},
+		{
+			name: "explain",
+			args: []string{"explain", "testdata/router.json", "ACCOUNT", "user600"},
+			code: 0,
+			stdout: "cluster:ACCOUNT table:user600 instance:beauty\n" +
+				`rule:{"instance":"beauty","match":"range","express":"user[512-1023]"}` + "\n",
+		},
+		{
+			name:   "explain not routed",
+			args:   []string{"explain", "testdata/router.json", "ACCOUNT", "user2000"},
+			code:   1,
+			stderr: "cluster:ACCOUNT table:user2000 not routed",
+		},
+		{
+			name:   "explain usage",
+			args:   []string{"explain", "testdata/router.json", "ACCOUNT"},
+			code:   2,
+			stderr: "explain need <config> <cluster> <table>",
+		},
+		{
+			name:   "matrix",
+			args:   []string{"matrix", "testdata/router.json", "ACCOUNT", "testdata/tables.txt"},
+			code:   0,
+			stdout: "user\taccount\nuser1\taccount\nuser600\tbeauty\nuser2000\t-\n",
+		},
+		{
+			name:   "matrix usage",
+			args:   []string{"matrix", "testdata/router.json"},
+			code:   2,
+			stderr: "matrix need <config> <cluster> <tables-file>",
+		},
+		{
+			name:   "no command",
+			args:   nil,
+			code:   2,
+			stderr: "usage:",
+		},
+		{
+			name:   "unknown command",
+			args:   []string{"nope"},
+			code:   1,
+			stderr: "unknown command:nope",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(tt.args, &stdout, &stderr)
+
+			if code != tt.code {
+				t.Errorf("exit code:%d want:%d stderr:%s", code, tt.code, stderr.String())
+			}
+
+			if stdout.String() != tt.stdout {
+				t.Errorf("stdout:\n%s\nwant:\n%s", stdout.String(), tt.stdout)
+			}
+
+			if !strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("stderr:%s want contains:%s", stderr.String(), tt.stderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/shawnfeng/sutil/slog"
+)
+
+type Options struct {
+	// 配置有任何错误时创建失败，而不是跳过出错的部分
+	Strict bool
+	// SqlScatter在每个instance上同时执行的查询数，0使用DEFAULT_SCATTER_PARALLEL
+	ScatterParallel int
+}
+
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+)
+
+// ConfigIssue 配置中的一个问题
+// Path是出错的配置位置，例如 instances.account.dbtype, cluster.ACCOUNT[1].express
+// Severity为error的配置项会被跳过，Strict模式下创建失败；warning不影响加载
+type ConfigIssue struct {
+	Severity string `json:"severity"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+}
+
+func (m ConfigIssue) String() string {
+	return fmt.Sprintf("[%s] %s: %s", m.Severity, m.Path, m.Message)
+}
+
+// ValidateConfig 执行NewRouter的所有配置检查，但不创建任何数据库连接
+// 配置不是合法的json时返回error，其他问题都通过ConfigIssue返回
+// 问题的级别和NewRouter一致，例如hash桶没有归属只是warning
+func ValidateConfig(jscfg []byte) ([]ConfigIssue, error) {
+	return ValidateConfigWithOptions(jscfg, Options{})
+}
+
+// ValidateConfigWithOptions 按照opts检查配置，Strict时问题的级别和Strict模式的NewRouterWithOptions一致
+func ValidateConfigWithOptions(jscfg []byte, opts Options) ([]ConfigIssue, error) {
+	var cfg routeConfig
+	if err := json.Unmarshal(jscfg, &cfg); err != nil {
+		return nil, fmt.Errorf("dbrouter config unmarshal:%s", err)
+	}
+
+	// 出错的规则也要继续检查后面的配置
+	ck := &configChecker{validate: true, atomic: true}
+	if _, _, err := buildRoute(&cfg, nil, opts, ck); err != nil {
+		if _, ok := err.(*ConfigError); !ok {
+			return nil, err
+		}
+	}
+
+	return ck.issues, nil
+}
+
+// RouteTable 只加载路由规则，不创建数据库连接
+// 用于离线检查某个表会被路由到哪个instance
+type RouteTable struct {
+	dbCls *dbCluster
+	dbIns *dbInstanceManager
+}
+
+// NewRouteTable 和NewRouter的加载规则一致，出错的配置项被跳过
+func NewRouteTable(jscfg []byte) (*RouteTable, error) {
+	var cfg routeConfig
+	if err := json.Unmarshal(jscfg, &cfg); err != nil {
+		return nil, fmt.Errorf("dbrouter config unmarshal:%s", err)
+	}
+
+	cls, inss, err := buildRoute(&cfg, nil, Options{}, &configChecker{validate: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return &RouteTable{dbCls: cls, dbIns: inss}, nil
+}
+
+// Instance 返回表被路由到的instance，没有找到返回空
+func (m *RouteTable) Instance(cluster, table string) string {
+	return m.dbCls.getInstance(cluster, table)
+}
+
+// RouterInfo 和Router.RouterInfo的输出一致
+func (m *RouteTable) RouterInfo(cluster, table string) string {
+	if lk := m.dbCls.getLookup(cluster, table); lk != nil {
+		return lookupInfo(lk, m.dbIns.getEntry(lk.Instance))
+
+	} else {
+		return "{}"
+	}
+}
+
+// ConfigError Strict模式下汇总所有error级别的配置问题
+type ConfigError struct {
+	Issues []ConfigIssue
+}
+
+func (m *ConfigError) Error() string {
+	msgs := make([]string, 0, len(m.Issues))
+	for _, i := range m.Issues {
+		msgs = append(msgs, i.String())
+	}
+
+	return fmt.Sprintf("dbrouter config has %d issues: %s", len(m.Issues), strings.Join(msgs, "; "))
+}
+
+// 收集配置中的问题，同时打日志
+type configChecker struct {
+	fun    string
+	issues []ConfigIssue
+	// ValidateConfig调用，不创建instance也不打日志
+	validate bool
+	// Reload和ValidateConfig调用，不管是否Strict，规则出错时记录后继续检查，
+	// 有error就不返回新的路由，Reload保持原来的配置生效
+	atomic bool
+}
+
+func (m *configChecker) add(path, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if !m.validate {
+		slog.Errorf("%s %s %s", m.fun, path, msg)
+	}
+	m.issues = append(m.issues, ConfigIssue{Severity: SEVERITY_ERROR, Path: path, Message: msg})
+}
+
+func (m *configChecker) warn(path, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if !m.validate {
+		slog.Warnf("%s %s %s", m.fun, path, msg)
+	}
+	m.issues = append(m.issues, ConfigIssue{Severity: SEVERITY_WARNING, Path: path, Message: msg})
+}
+
+func (m *configChecker) errors() []ConfigIssue {
+	var res []ConfigIssue
+	for _, i := range m.issues {
+		if i.Severity == SEVERITY_ERROR {
+			res = append(res, i)
+		}
+	}
+
+	return res
+}
+
+// map的key排序，保证检查和报告的顺序固定
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	res := make([]string, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, k.String())
+	}
+
+	sort.Strings(res)
+	return res
+}
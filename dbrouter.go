@@ -5,27 +5,51 @@
 package dbrouter
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/shawnfeng/sutil/slog"
 	"github.com/shawnfeng/sutil/stat"
-	//"sync"
-	"encoding/json"
+	"github.com/shawnfeng/sutil/stime"
+	"sort"
+	"strings"
+	"sync"
 )
 
 const (
 	DB_TYPE_MONGO    = "mongo"
 	DB_TYPE_MYSQL    = "mysql"
 	DB_TYPE_POSTGRES = "postgres"
+	DB_TYPE_SQLITE   = "sqlite3"
+	DB_TYPE_REDIS    = "redis"
+
+	// sqlite的path配置为这个值时使用内存数据库
+	// 内存库按dbname区分，同一个进程里dbname相同的instance共享数据，
+	// 不同Router之间也一样，所有连接关闭后数据丢失
+	SQLITE_MEMORY = ":memory:"
 )
 
 type dbLookupCfg struct {
 	Instance string `json:"instance"`
-	// match type: full or regex
+	// match type: full, regex, range or hash
 	Match   string `json:"match"`
 	Express string `json:"express"`
+	// hash match only: express is the table prefix and the digits
+	// after it are the shard key, e.g. user123 hashes key 123,
+	// buckets is the total bucket count of the prefix,
+	// slots are the buckets owned by this instance
+	Buckets int   `json:"buckets,omitempty"`
+	Slots   []int `json:"slots,omitempty"`
+	// regex match only: higher priority is tried first,
+	// rules with the same priority keep the config order
+	Priority int `json:"priority,omitempty"`
 }
 
 func (m *dbLookupCfg) String() string {
+	if m.Match == MATCH_HASH {
+		return fmt.Sprintf("ins:%s exp:%s match:%s buckets:%d slots:%v", m.Instance, m.Express, m.Match, m.Buckets, m.Slots)
+	}
 	return fmt.Sprintf("ins:%s exp:%s match:%s", m.Instance, m.Express, m.Match)
 }
 
@@ -42,25 +66,152 @@ type routeConfig struct {
 }
 
 type Router struct {
+	// 保护路由快照的切换
+	mu    sync.RWMutex
 	dbCls *dbCluster
 	dbIns *dbInstanceManager
 	stat  *stat.StatReport
+
+	// Reload串行执行
+	reloadMu sync.Mutex
+
+	// NewRouterFromFile启动的配置文件监控
+	watcher *fileWatcher
+
+	opts Options
+
+	// Close之后不再接受新的查询
+	closed bool
+
+	// Reload替换下来还没关闭的instance，从map中取走的一方负责关闭
+	// Close时取走全部，和当前的instance一起等待查询结束
+	retiring map[*insEntry]string
+	retireWg sync.WaitGroup
+	// Close时关闭，通知等待retire的goroutine退出
+	done chan struct{}
 }
 
+var ErrRouterClosed = errors.New("dbrouter: router closed")
+
 func (m *Router) String() string {
-	return fmt.Sprintf("%s", m.dbCls.clusters)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return fmt.Sprintf("%v", m.dbCls.clusters)
 }
 
 func (m *Router) RouterInfo(cluster, table string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	if lk := m.dbCls.getLookup(cluster, table); lk != nil {
-		rt, _ := json.Marshal(lk)
-		return string(rt)
+		return lookupInfo(lk, m.dbIns.getEntry(lk.Instance))
 
 	} else {
 		return "{}"
 	}
 }
 
+// 规则的json，sql类型的instance附带生效的连接池配置
+func lookupInfo(lk *dbLookupCfg, e *insEntry) string {
+	info := struct {
+		*dbLookupCfg
+		Pool *sqlPool `json:"pool,omitempty"`
+	}{
+		dbLookupCfg: lk,
+	}
+
+	if e != nil {
+		if db, ok := e.ins.(*dbSql); ok {
+			info.Pool = &db.pool
+
+		} else if e.ins == nil && e.cfg != nil && isSqlType(e.cfg.Dbtype) {
+			// RouteTable没有创建instance，从配置中解析
+			if db, err := parsedbSql(e.cfg.Dbtype, e.cfg.Dbname, e.cfg.Dbcfg); err == nil {
+				info.Pool = &db.pool
+			}
+		}
+	}
+
+	rt, _ := json.Marshal(info)
+	return string(rt)
+}
+
+// Clusters 配置了规则的cluster，按名字排序
+func (m *Router) Clusters() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return sortedKeys(m.dbCls.clusters)
+}
+
+// Instances 创建成功的instance，按名字排序
+func (m *Router) Instances() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return sortedKeys(m.dbIns.instances)
+}
+
+// RulesForInstance 指向instance的所有规则，下线instance前用来确认影响的cluster和表
+func (m *Router) RulesForInstance(name string) []RuleInfo {
+	if name == "" {
+		return nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.dbCls.rules(name)
+}
+
+// 在当前的路由快照里查找instance并占用，用完需要release
+// 和Reload的切换互斥，保证拿到的instance不会在查询过程中被关闭
+// Router关闭后返回ErrRouterClosed
+func (m *Router) acquireInstance(getInstance func(*dbCluster) string) (string, *insEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return "", nil, ErrRouterClosed
+	}
+
+	name := getInstance(m.dbCls)
+	if name == "" {
+		return "", nil, nil
+	}
+
+	return name, m.dbIns.acquire(name), nil
+}
+
+// InstanceExec 把表路由到的Instance交给query执行
+// 主要给通过Register注册的自定义类型使用，query中自己做类型断言
+func (m *Router) InstanceExec(cluster, table string, query func(Instance) error) error {
+	stall := stime.NewTimeStat()
+
+	ins_name, entry, err := m.acquireInstance(func(cls *dbCluster) string {
+		return cls.getInstance(cluster, table)
+	})
+	if err != nil {
+		return err
+	}
+
+	if ins_name == "" {
+		return fmt.Errorf("cluster instance not find: cluster:%s table:%s", cluster, table)
+	}
+
+	if entry == nil {
+		return fmt.Errorf("db instance not find: cluster:%s table:%s", cluster, table)
+	}
+	defer entry.release()
+
+	defer func() {
+		m.stat.IncQuery(cluster, table, stall.Duration())
+	}()
+
+	return query(entry.ins)
+}
+
 func (m *Router) StatInfo() []*stat.QueryStat {
 	return m.stat.StatInfo()
 }
@@ -94,34 +245,235 @@ func checkVarname(varname string) error {
 	return nil
 }
 
-func NewRouter(jscfg []byte) (*Router, error) {
-	fun := "NewRouter -->"
-
-	r := &Router{
+func newRouter() *Router {
+	return &Router{
 		dbCls: &dbCluster{
 			clusters: make(map[string]*clsEntry),
 		},
 
 		dbIns: &dbInstanceManager{
-			instances: make(map[string]dbInstance),
+			instances: make(map[string]*insEntry),
 		},
 
 		stat: stat.NewStat(),
+
+		retiring: make(map[*insEntry]string),
+		done:     make(chan struct{}),
 	}
+}
+
+func NewRouter(jscfg []byte) (*Router, error) {
+	return NewRouterWithOptions(jscfg, Options{})
+}
+
+// NewRouterWithOptions 按照opts创建Router
+// 非Strict模式和NewRouter一致，出错的配置项打日志后跳过
+// Strict模式下配置有任何错误都返回*ConfigError，不会返回只加载了一部分的Router
+func NewRouterWithOptions(jscfg []byte, opts Options) (*Router, error) {
+	fun := "NewRouter -->"
+
+	r := newRouter()
+	r.opts = opts
 
 	var cfg routeConfig
 	err := json.Unmarshal(jscfg, &cfg)
 	if err != nil {
+		if opts.Strict {
+			return nil, &ConfigError{Issues: []ConfigIssue{{Severity: SEVERITY_ERROR, Path: "$", Message: fmt.Sprintf("unmarshal err:%s", err)}}}
+		}
 		//return nil, fmt.Errorf("dbrouter config unmarshal:%s", err)
 		slog.Errorf("%s dbrouter config unmarshal:%s", fun, err.Error())
 		return r, nil
 	}
 
-	inss := cfg.Instances
-	for ins, db := range inss {
+	cls, inss, err := buildRoute(&cfg, nil, opts, &configChecker{fun: fun})
+	if err != nil {
+		return nil, err
+	}
+
+	r.dbCls, r.dbIns = cls, inss
+	return r, nil
+}
+
+// Reload 用新的配置重建路由并原子替换
+// 配置没有变化的instance复用原来的连接，被删除或者修改的instance
+// 等正在执行的查询结束后关闭
+// 不管是否Strict，新配置有任何error都不替换，返回汇总的*ConfigError
+func (m *Router) Reload(jscfg []byte) error {
+	fun := "Router.Reload -->"
+
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	var cfg routeConfig
+	if err := json.Unmarshal(jscfg, &cfg); err != nil {
+		return fmt.Errorf("dbrouter config unmarshal:%s", err)
+	}
+
+	m.mu.RLock()
+	old, closed := m.dbIns, m.closed
+	m.mu.RUnlock()
+
+	if closed {
+		return ErrRouterClosed
+	}
+
+	cls, inss, err := buildRoute(&cfg, old, m.opts, &configChecker{fun: fun, atomic: true})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.dbCls, m.dbIns = cls, inss
+	m.mu.Unlock()
+
+	for name, e := range old.instances {
+		if inss.instances[name] == e {
+			continue
+		}
+
+		slog.Infof("%s retire instance:%s", fun, name)
+		drained := e.retire()
+
+		m.mu.Lock()
+		m.retiring[e] = name
+		m.mu.Unlock()
+
+		m.retireWg.Add(1)
+		go func(name string, e *insEntry) {
+			defer m.retireWg.Done()
+
+			select {
+			case <-drained:
+			case <-m.done:
+				// 由Close等待和关闭
+				return
+			}
+
+			if !m.takeRetiring(e) {
+				return
+			}
+
+			if err := e.ins.Close(); err != nil {
+				slog.Errorf("%s close instance:%s err:%s", fun, name, err.Error())
+			}
+		}(name, e)
+	}
+
+	return nil
+}
+
+// 从retiring中取走e，返回false说明已经被Close取走
+func (m *Router) takeRetiring(e *insEntry) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.retiring[e]; !ok {
+		return false
+	}
+
+	delete(m.retiring, e)
+	return true
+}
+
+// Close 关闭Router，之后的查询都返回ErrRouterClosed
+// 等待正在执行的查询结束后关闭所有instance的连接，包括之前Reload替换下来还没关闭的，
+// ctx超时的时候不再等待，直接关闭连接，并返回没有等到查询结束的instance
+func (m *Router) Close(ctx context.Context) error {
+	fun := "Router.Close -->"
+
+	m.StopWatch()
+
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	m.mu.Lock()
+	inss, closed := m.dbIns, m.closed
+	retiring := m.retiring
+	m.retiring = nil
+	m.closed = true
+	m.mu.Unlock()
+
+	if closed {
+		return nil
+	}
+	close(m.done)
+
+	type closeEntry struct {
+		name string
+		e    *insEntry
+	}
+
+	var entries []closeEntry
+	for _, name := range sortedKeys(inss.instances) {
+		entries = append(entries, closeEntry{name, inss.instances[name]})
+	}
+
+	// 替换下来的instance可能和当前的重名，加上后缀区分
+	var retired []closeEntry
+	for e, name := range retiring {
+		retired = append(retired, closeEntry{name + "(retired)", e})
+	}
+	sort.Slice(retired, func(i, j int) bool { return retired[i].name < retired[j].name })
+	entries = append(entries, retired...)
+
+	drained := make([]<-chan struct{}, len(entries))
+	for i, ce := range entries {
+		drained[i] = ce.e.retire()
+	}
+
+	var undrained []string
+	for i, ce := range entries {
+		// ctx结束后两个case可能同时就绪，先检查是否已经drain
+		select {
+		case <-drained[i]:
+		default:
+			select {
+			case <-drained[i]:
+			case <-ctx.Done():
+				undrained = append(undrained, ce.name)
+			}
+		}
+
+		if err := ce.e.ins.Close(); err != nil {
+			slog.Errorf("%s close instance:%s err:%s", fun, ce.name, err.Error())
+		}
+	}
+
+	// 已经取走retiring的goroutine正在关闭连接
+	m.retireWg.Wait()
+
+	if len(undrained) > 0 {
+		return fmt.Errorf("dbrouter close instances not drained: %s err:%s", strings.Join(undrained, ","), ctx.Err())
+	}
+
+	return nil
+}
+
+// 根据配置构建路由和instance，old中配置相同的instance直接复用
+// 配置问题都记录到ck中，出错时新建的instance会被关闭
+// Strict或者ck.atomic时有error返回*ConfigError，否则跳过出错的配置项
+func buildRoute(cfg *routeConfig, old *dbInstanceManager, opts Options, ck *configChecker) (*dbCluster, *dbInstanceManager, error) {
+
+	cls := &dbCluster{
+		clusters: make(map[string]*clsEntry),
+	}
+
+	inss := &dbInstanceManager{
+		instances: make(map[string]*insEntry),
+	}
+
+	for _, ins := range sortedKeys(cfg.Instances) {
+		db := cfg.Instances[ins]
+		path := "instances." + ins
+
 		if er := checkVarname(ins); er != nil {
-			//return nil, fmt.Errorf("instances name config err:%s", er)
-			slog.Errorf("%s instances name config err:%s", fun, err.Error())
+			ck.add(path, "instances name config err:%s", er)
+			continue
+		}
+
+		if db == nil {
+			ck.add(path, "instance config is null")
 			continue
 		}
 
@@ -130,93 +482,154 @@ func NewRouter(jscfg []byte) (*Router, error) {
 		cfg := db.Dbcfg
 
 		if er := checkVarname(tp); er != nil {
-			//return nil, fmt.Errorf("dbtype instance:%s err:%s", ins, er)
-			slog.Errorf("%s dbtype instance:%s err:%s", fun, ins, er.Error())
+			ck.add(path+".dbtype", "dbtype instance:%s err:%s", ins, er)
 			continue
 		}
 
 		if er := checkVarname(dbname); er != nil {
-			//return nil, fmt.Errorf("dbname instance:%s err:%s", ins, er)
-			slog.Errorf("%sdbname instance:%s err:%s", fun, ins, er.Error())
+			ck.add(path+".dbname", "dbname instance:%s err:%s", ins, er)
 			continue
 		}
 
 		if len(cfg) == 0 {
-			//return nil, fmt.Errorf("empty dbcfg instance:%s", ins)
-			slog.Errorf("%s empty dbcfg instance:%s", fun, ins)
+			ck.add(path+".dbcfg", "empty dbcfg instance:%s", ins)
 			continue
 		}
 
-		// 工厂化构造，db类型领出来
-		if tp == DB_TYPE_MONGO {
-			dbi, err := NewdbMongo(tp, dbname, cfg)
-			if err != nil {
-				slog.Errorf("%s init mongo config: %s err: %s", fun, cfg, err.Error())
-				continue
+		// 工厂化构造，db类型通过Register注册
+		dr := getDriver(tp)
+		if dr == nil {
+			ck.add(path+".dbtype", "db type not support:%s", tp)
+			continue
+		}
+
+		// 只检查配置，注册时没有提供检查方法的dbtype不检查dbcfg
+		if ck.validate {
+			if dr.check != nil {
+				if err := dr.check(dbname, cfg); err != nil {
+					ck.add(path+".dbcfg", "instance:%s config err:%s", ins, err)
+					continue
+				}
 			}
 
-			r.dbIns.add(ins, dbi)
-		} else if tp == DB_TYPE_MYSQL || tp == DB_TYPE_POSTGRES {
-			dbi, err := NewdbSql(tp, dbname, cfg)
-			if err != nil {
-				slog.Errorf("%s init mysql config: %s err: %s", fun, cfg, err.Error())
+			inss.add(ins, newInsEntry(nil, db))
+			continue
+		}
+
+		if old != nil {
+			if e := old.getEntry(ins); e != nil && e.sameConfig(db) {
+				inss.add(ins, e)
 				continue
 			}
+		}
 
-			r.dbIns.add(ins, dbi)
-		} else {
-			slog.Errorf("%s db type not support:%s", fun, tp)
-			//return nil, fmt.Errorf("db type not support:%s", tp)
+		dbi, err := dr.factory(dbname, cfg)
+		if err != nil {
+			ck.add(path+".dbcfg", "init %s config: %s err: %s", tp, cfg, err)
+			continue
 		}
 
+		// Router关闭或者Reload替换时会调用Close，不能保存nil
+		if dbi == nil {
+			ck.add(path+".dbcfg", "factory returned nil instance")
+			continue
+		}
+
+		inss.add(ins, newInsEntry(dbi, db))
 	}
 
-	cls := cfg.Cluster
-	for c, ins := range cls {
+	for _, c := range sortedKeys(cfg.Cluster) {
+		ins := cfg.Cluster[c]
+		path := "cluster." + c
+
 		if er := checkVarname(c); er != nil {
-			slog.Errorf("%s cluster config name err:%s", fun, err)
+			ck.add(path, "cluster config name err:%s", er)
 			continue
-			//return nil, fmt.Errorf("cluster config name err:%s", er)
 		}
 
 		if len(ins) == 0 {
-			slog.Errorf("%s empty instance in cluster:%s", fun, c)
+			ck.add(path, "empty instance in cluster:%s", c)
 			continue
-			//return nil, fmt.Errorf("empty instance in cluster:%s", c)
 		}
 
-		for _, v := range ins {
+		for i, v := range ins {
+			path := fmt.Sprintf("%s[%d]", path, i)
+
+			if v == nil {
+				ck.add(path, "rule config is null")
+				continue
+			}
+
 			if len(v.Express) == 0 {
-				slog.Errorf("%s empty express in cluster:%s instance:%s", fun, c, v.Instance)
+				ck.add(path+".express", "empty express in cluster:%s instance:%s", c, v.Instance)
 				continue
-				//return nil, fmt.Errorf("empty express in cluster:%s instance:%s", c, v.Instance)
 			}
 
 			if er := checkVarname(v.Match); er != nil {
-				slog.Errorf("%s match in cluster:%s instance:%s err:%s", fun, c, v.Instance, err)
+				ck.add(path+".match", "match in cluster:%s instance:%s err:%s", c, v.Instance, er)
 				continue
-				//return nil, fmt.Errorf("match in cluster:%s instance:%s err:%s", c, v.Instance, er)
 			}
 
 			if er := checkVarname(v.Instance); er != nil {
-				//return nil, fmt.Errorf("instance name in cluster:%s instance:%s err:%s", c, v.Instance, er)
-				slog.Errorf("%s instance name in cluster:%s instance:%s err:%s", fun, c, v.Instance, err)
+				ck.add(path+".instance", "instance name in cluster:%s instance:%s err:%s", c, v.Instance, er)
 				continue
 			}
 
-			if r.dbIns.get(v.Instance) == nil {
-				slog.Errorf("%s in cluster:%s instance:%s not found", fun, c, v.Instance)
+			if inss.getEntry(v.Instance) == nil {
+				ck.add(path+".instance", "in cluster:%s instance:%s not found", c, v.Instance)
 				continue
-				//return nil, fmt.Errorf("in cluster:%s instance:%s not found", c, v.Instance)
 			}
 
-			if err := r.dbCls.addInstance(c, v); err != nil {
-				return nil, fmt.Errorf("load instance lookup rule err:%s", err.Error())
+			if err := cls.addInstance(c, v); err != nil {
+				if opts.Strict || ck.atomic {
+					ck.add(path, "load instance lookup rule err:%s", err)
+					continue
+				}
+
+				inss.closeNew(old)
+				return nil, nil, fmt.Errorf("load instance lookup rule err:%s", err.Error())
 			}
 		}
 	}
 
-	return r, nil
+	unowned := cls.unownedSlots()
+	for _, c := range sortedKeys(unowned) {
+		for _, exp := range sortedKeys(unowned[c]) {
+			if opts.Strict {
+				ck.add("cluster."+c, "hash express:%s buckets not owned by any instance slots:%v", exp, unowned[c][exp])
+			} else {
+				ck.warn("cluster."+c, "hash express:%s buckets not owned by any instance slots:%v", exp, unowned[c][exp])
+			}
+		}
+	}
+
+	// 按样例表名检查，不保证找出全部交叠
+	for _, a := range cls.ambiguities() {
+		ck.warn("cluster."+a.cluster, "table matched by more than one rule (best-effort check, may miss overlaps) %s", a)
+	}
+
+	// 没有被任何规则引用的instance
+	used := make(map[string]bool)
+	for _, rules := range cfg.Cluster {
+		for _, v := range rules {
+			if v != nil {
+				used[v.Instance] = true
+			}
+		}
+	}
+
+	for _, ins := range sortedKeys(inss.instances) {
+		if !used[ins] {
+			ck.warn("instances."+ins, "instance:%s not used by any cluster", ins)
+		}
+	}
+
+	if errs := ck.errors(); (opts.Strict || ck.atomic) && len(errs) > 0 {
+		inss.closeNew(old)
+		return nil, nil, &ConfigError{Issues: errs}
+	}
+
+	return cls, inss, nil
 }
 
 // 通过传入配置方式加载，配置的结构对外面隐藏
@@ -7,7 +7,10 @@ package dbrouter
 
 
 import (
+	"context"
 	"log"
+	"reflect"
+	"strings"
 	"fmt"
 	"time"
 	"io/ioutil"
@@ -191,3 +194,472 @@ func newrouter(t *testing.T) {
 
 }
 
+
+func TestReload(t *testing.T) {
+	cfg1 := []byte(`{
+		"cluster": {
+			"ACCOUNT": [
+				{"instance": "account", "match": "range", "express": "user[0-511]"},
+				{"instance": "beauty", "match": "range", "express": "user[512-1023]"}
+			]
+		},
+		"instances": {
+			"account": {"dbtype": "mongo", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:27017"]}},
+			"beauty": {"dbtype": "mongo", "dbname": "women", "dbcfg": {"addrs": ["127.0.0.1:27017"]}}
+		}
+	}`)
+
+	cfg2 := []byte(`{
+		"cluster": {
+			"ACCOUNT": [
+				{"instance": "account", "match": "range", "express": "user[0-1023]"}
+			]
+		},
+		"instances": {
+			"account": {"dbtype": "mongo", "dbname": "taccount", "dbcfg": {"addrs":["127.0.0.1:27017"]}}
+		}
+	}`)
+
+	r, err := NewRouter(cfg1)
+	if err != nil {
+		t.Fatalf("new router error:%s", err)
+	}
+
+	if ins := r.dbCls.getInstance("ACCOUNT", "user600"); ins != "beauty" {
+		t.Errorf("user600 route to:%s", ins)
+	}
+
+	account := r.dbIns.getEntry("account")
+	beauty := r.dbIns.getEntry("beauty")
+
+	// beauty正在查询，Reload后要等它结束才关闭
+	if !beauty.acquire() {
+		t.Fatalf("acquire beauty fail")
+	}
+
+	if err := r.Reload([]byte("{bad json")); err == nil {
+		t.Errorf("reload bad config should fail")
+	}
+
+	// 非Strict模式下instance出错也不替换，原来的配置继续生效
+	cfg3 := []byte(`{
+		"cluster": {
+			"ACCOUNT": [
+				{"instance": "account", "match": "range", "express": "user[0-511]"},
+				{"instance": "beauty", "match": "range", "express": "user[512-1023]"}
+			]
+		},
+		"instances": {
+			"account": {"dbtype": "mongo", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:27017"]}},
+			"beauty": {"dbtype": "nosuchdb", "dbname": "women", "dbcfg": {"addrs": ["127.0.0.1:27017"]}}
+		}
+	}`)
+
+	err = r.Reload(cfg3)
+	if ce, ok := err.(*ConfigError); !ok || len(ce.Issues) != 2 {
+		t.Errorf("reload with bad instance err:%v", err)
+	}
+
+	if ins := r.dbCls.getInstance("ACCOUNT", "user600"); ins != "beauty" {
+		t.Errorf("user600 route to:%s after failed reload", ins)
+	}
+
+	if r.dbIns.getEntry("beauty") != beauty {
+		t.Errorf("instance replaced after failed reload")
+	}
+
+	if err := r.Reload(cfg2); err != nil {
+		t.Fatalf("reload error:%s", err)
+	}
+
+	if ins := r.dbCls.getInstance("ACCOUNT", "user600"); ins != "account" {
+		t.Errorf("user600 route to:%s after reload", ins)
+	}
+
+	if r.dbIns.getEntry("account") != account {
+		t.Errorf("unchanged instance not reused")
+	}
+
+	if r.dbIns.getEntry("beauty") != nil {
+		t.Errorf("removed instance still exist")
+	}
+
+	if beauty.acquire() {
+		t.Errorf("retired instance can not be acquired")
+	}
+
+	select {
+	case <-beauty.drained:
+		t.Errorf("retired instance drained before query finish")
+	default:
+	}
+
+	beauty.release()
+
+	select {
+	case <-beauty.drained:
+	case <-time.After(time.Second):
+		t.Errorf("retired instance not drained")
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	cfg := []byte(`{
+		"cluster": {
+			"ACCOUNT": [
+				{"instance": "account", "match": "regex", "express": "user[0-9]+"},
+				{"instance": "acount", "match": "regex", "express": "member[0-9]+"},
+				{"instance": "account", "match": "regex", "express": "fuck[0-9"},
+				{"instance": "account", "match": "hash", "express": "auth", "buckets": 4, "slots": [0, 1]}
+			],
+			"_UGC": [
+				{"instance": "account", "match": "regex", "express": "lucky[0-9]+"}
+			]
+		},
+		"instances": {
+			"account": {"dbtype": "mongo", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:27017"]}},
+			"beauty": {"dbtype": "redisx", "dbname": "women", "dbcfg": {"addrs": ["127.0.0.1:27017"]}}
+		}
+	}`)
+
+	r, err := NewRouterWithOptions(cfg, Options{Strict: true})
+	if err == nil || r != nil {
+		t.Fatalf("strict config should fail")
+	}
+
+	cerr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("error type:%T", err)
+	}
+	log.Println(cerr)
+
+	paths := make(map[string]bool)
+	for _, i := range cerr.Issues {
+		paths[i.Path] = true
+	}
+
+	for _, p := range []string{
+		"instances.beauty.dbtype",
+		"cluster.ACCOUNT[1].instance",
+		"cluster.ACCOUNT[2]",
+		"cluster.ACCOUNT",
+		"cluster._UGC",
+	} {
+		if !paths[p] {
+			t.Errorf("issue path:%s not found in:%v", p, cerr.Issues)
+		}
+	}
+
+	if len(cerr.Issues) != 5 {
+		t.Errorf("issues count:%d", len(cerr.Issues))
+	}
+
+	for _, i := range cerr.Issues {
+		if i.Severity != SEVERITY_ERROR {
+			t.Errorf("issue severity:%s", i)
+		}
+	}
+
+	_, err = NewRouterWithOptions([]byte("{bad json"), Options{Strict: true})
+	cerr, ok = err.(*ConfigError)
+	if !ok || len(cerr.Issues) != 1 || cerr.Issues[0].Severity != SEVERITY_ERROR || cerr.Issues[0].Path != "$" {
+		t.Errorf("strict bad json err:%v", err)
+	}
+
+	if r, err := NewRouter([]byte("{bad json")); err != nil || r == nil {
+		t.Errorf("default mode bad json should return empty router")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("./router.json")
+	if err != nil {
+		t.Fatalf("config error")
+	}
+
+	issues, err := ValidateConfig(data)
+	if err != nil {
+		t.Fatalf("validate err:%s", err)
+	}
+
+	// router.json里beauty和test_account没有被引用
+	warns := make(map[string]bool)
+	for _, i := range issues {
+		if i.Severity != SEVERITY_WARNING {
+			t.Errorf("unexpected issue:%s", i)
+		}
+		warns[i.Path] = true
+	}
+
+	if !warns["instances.beauty"] || !warns["instances.test_account"] || len(issues) != 2 {
+		t.Errorf("unused instance not reported:%v", issues)
+	}
+
+	cfg := []byte(`{
+		"cluster": {
+			"ACCOUNT": [
+				{"instance": "account", "match": "regex", "express": "user[0-9]+"},
+				{"instance": "account", "match": "regex", "express": "user[0-9]+"},
+				{"instance": "mysql", "match": "regex", "express": "user1[0-9]*"},
+				{"instance": "nothere", "match": "full", "express": "member"},
+				{"instance": "account", "match": "regex", "express": "fuck[0-9"}
+			]
+		},
+		"instances": {
+			"account": {"dbtype": "mongo", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:27017"]}},
+			"mysql": {"dbtype": "mysql", "dbname": "tmysql", "dbcfg": {"addrs": ["127.0.0.1:3306"]}},
+			"badaddrs": {"dbtype": "mysql", "dbname": "tmysql", "dbcfg": {"addrs": ["127.0.0.1:3306", "127.0.0.1:3307"]}}
+		}
+	}`)
+
+	issues, err = ValidateConfig(cfg)
+	if err != nil {
+		t.Fatalf("validate err:%s", err)
+	}
+	log.Println(issues)
+
+	want := map[string]string{
+		"instances.badaddrs.dbcfg":    SEVERITY_ERROR,
+		"cluster.ACCOUNT[1]":          SEVERITY_ERROR,
+		"cluster.ACCOUNT[3].instance": SEVERITY_ERROR,
+		"cluster.ACCOUNT[4]":          SEVERITY_ERROR,
+		"cluster.ACCOUNT":             SEVERITY_WARNING,
+	}
+
+	got := make(map[string]string)
+	for _, i := range issues {
+		got[i.Path] = i.Severity
+	}
+
+	for p, sev := range want {
+		if got[p] != sev {
+			t.Errorf("issue path:%s severity:%s want:%s", p, got[p], sev)
+		}
+	}
+
+	if len(issues) != len(want) {
+		t.Errorf("issues:%v", issues)
+	}
+
+	if _, err := ValidateConfig([]byte("{bad json")); err == nil {
+		t.Errorf("bad json should fail")
+	}
+
+	// hash桶没有归属，默认和NewRouter一样是warning，Strict时是error
+	cfg = []byte(`{
+		"cluster": {
+			"ACCOUNT": [
+				{"instance": "account", "match": "hash", "express": "user", "buckets": 4, "slots": [0]}
+			]
+		},
+		"instances": {
+			"account": {"dbtype": "mongo", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:27017"]}}
+		}
+	}`)
+
+	for _, strict := range []bool{false, true} {
+		issues, err = ValidateConfigWithOptions(cfg, Options{Strict: strict})
+		sev := SEVERITY_WARNING
+		if strict {
+			sev = SEVERITY_ERROR
+		}
+
+		if err != nil || len(issues) != 1 || issues[0].Path != "cluster.ACCOUNT" || issues[0].Severity != sev {
+			t.Errorf("strict:%v unowned slots issues:%v err:%v", strict, issues, err)
+		}
+	}
+
+	if issues, err := ValidateConfig(cfg); err != nil || len(issues) != 1 || issues[0].Severity != SEVERITY_WARNING {
+		t.Errorf("default unowned slots issues:%v err:%v", issues, err)
+	}
+}
+
+func TestRouteTable(t *testing.T) {
+	data, err := ioutil.ReadFile("./router.json")
+	if err != nil {
+		t.Fatalf("config error")
+	}
+
+	rt, err := NewRouteTable(data)
+	if err != nil {
+		t.Fatalf("route table err:%s", err)
+	}
+
+	if ins := rt.Instance("ACCOUNT", "fuck10000"); ins != "account" {
+		t.Errorf("fuck10000 route to:%s", ins)
+	}
+
+	if ins := rt.Instance("ACCOUNT", "nope"); ins != "" {
+		t.Errorf("nope route to:%s", ins)
+	}
+
+	if info := rt.RouterInfo("UGC", "lucky1"); info != `{"instance":"account","match":"regex","express":"lucky[0-9]+"}` {
+		t.Errorf("router info:%s", info)
+	}
+}
+
+func TestClose(t *testing.T) {
+	cfg := []byte(`{
+		"cluster": {"ACCOUNT": [
+			{"instance": "busy", "match": "full", "express": "busy"},
+			{"instance": "idle", "match": "full", "express": "idle"}
+		]},
+		"instances": {
+			"busy": {"dbtype": "sqlite3", "dbname": "tclosebusy", "dbcfg": {"path": ":memory:"}},
+			"idle": {"dbtype": "sqlite3", "dbname": "tcloseidle", "dbcfg": {"path": ":memory:"}}
+		}
+	}`)
+
+	r, err := NewRouterWithOptions(cfg, Options{Strict: true})
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+
+	// busy上有一个查询一直没有结束
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	go r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		close(started)
+		<-finish
+		return nil
+	}, "busy")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = r.Close(ctx)
+	if err == nil || !strings.Contains(err.Error(), "busy") || strings.Contains(err.Error(), "idle") {
+		t.Errorf("close err:%v", err)
+	}
+	close(finish)
+
+	err = r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error { return nil }, "idle")
+	if err != ErrRouterClosed {
+		t.Errorf("exec after close err:%v", err)
+	}
+
+	if err := r.Reload(cfg); err != ErrRouterClosed {
+		t.Errorf("reload after close err:%v", err)
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Errorf("close twice err:%s", err)
+	}
+}
+
+func TestCloseRetired(t *testing.T) {
+	cfg := []byte(`{
+		"cluster": {"ACCOUNT": [
+			{"instance": "old", "match": "full", "express": "user"}
+		]},
+		"instances": {
+			"old": {"dbtype": "sqlite3", "dbname": "tcloseold", "dbcfg": {"path": ":memory:"}}
+		}
+	}`)
+
+	r, err := NewRouterWithOptions(cfg, Options{Strict: true})
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+
+	old := r.dbIns.getEntry("old")
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	go r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		close(started)
+		<-finish
+		return nil
+	}, "user")
+	<-started
+
+	// 替换掉old，查询还没结束
+	cfg2 := []byte(`{
+		"cluster": {"ACCOUNT": [
+			{"instance": "new", "match": "full", "express": "user"}
+		]},
+		"instances": {
+			"new": {"dbtype": "sqlite3", "dbname": "tclosenew", "dbcfg": {"path": ":memory:"}}
+		}
+	}`)
+
+	if err := r.Reload(cfg2); err != nil {
+		t.Fatalf("reload err:%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = r.Close(ctx)
+	if err == nil || !strings.Contains(err.Error(), "old(retired)") || strings.Contains(err.Error(), "new") {
+		t.Errorf("close err:%v", err)
+	}
+	close(finish)
+
+	// Close返回时替换下来的连接也已经关闭
+	if err := old.ins.(*dbSql).db.Ping(); err == nil {
+		t.Errorf("retired instance not closed")
+	}
+}
+
+func TestRulesForInstance(t *testing.T) {
+	cfg := []byte(`{
+		"cluster": {
+			"ACCOUNT": [
+				{"instance": "a", "match": "full", "express": "user"},
+				{"instance": "b", "match": "regex", "express": "log_[a-z]+"},
+				{"instance": "a", "match": "range", "express": "user[0-9]"},
+				{"instance": "b", "match": "range", "express": "user[10-19]"}
+			],
+			"ORDER": [
+				{"instance": "a", "match": "hash", "express": "order", "buckets": 4, "slots": [0, 1]},
+				{"instance": "b", "match": "hash", "express": "order", "buckets": 4, "slots": [2, 3]},
+				{"instance": "a", "match": "regex", "express": "bill[0-9]+", "priority": 2}
+			]
+		},
+		"instances": {
+			"a": {"dbtype": "memkv", "dbname": "kva", "dbcfg": {}},
+			"b": {"dbtype": "memkv", "dbname": "kvb", "dbcfg": {}},
+			"idle": {"dbtype": "memkv", "dbname": "kvc", "dbcfg": {}}
+		}
+	}`)
+
+	r, err := NewRouterWithOptions(cfg, Options{Strict: true})
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+	defer r.Close(context.Background())
+
+	if cls := r.Clusters(); !reflect.DeepEqual(cls, []string{"ACCOUNT", "ORDER"}) {
+		t.Errorf("clusters:%v", cls)
+	}
+
+	if inss := r.Instances(); !reflect.DeepEqual(inss, []string{"a", "b", "idle"}) {
+		t.Errorf("instances:%v", inss)
+	}
+
+	want := []RuleInfo{
+		{Cluster: "ACCOUNT", Instance: "a", Match: MATCH_FULL, Express: "user"},
+		{Cluster: "ACCOUNT", Instance: "a", Match: MATCH_RANGE, Express: "user[0-9]"},
+		{Cluster: "ORDER", Instance: "a", Match: MATCH_REGEX, Express: "bill[0-9]+", Priority: 2},
+		{Cluster: "ORDER", Instance: "a", Match: MATCH_HASH, Express: "order", Buckets: 4, Slots: []int{0, 1}},
+	}
+	if rules := r.RulesForInstance("a"); !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules for a:%+v", rules)
+	}
+
+	// 修改返回的Slots不影响路由
+	rules := r.RulesForInstance("a")
+	rules[3].Slots[0] = 3
+	if rules := r.RulesForInstance("a"); !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules for a changed by caller:%+v", rules)
+	}
+
+	if rules := r.RulesForInstance("b"); len(rules) != 3 {
+		t.Errorf("rules for b:%+v", rules)
+	}
+
+	if rules := r.RulesForInstance("idle"); len(rules) != 0 {
+		t.Errorf("rules for idle:%+v", rules)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sync"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/go-sql-driver/mysql"
+)
+
+// sql instance的tls配置，文件在建立连接时才读取
+// mysql注册为驱动的tls配置，postgres转换为sslmode、sslrootcert、sslcert、sslkey
+// 没有skip_verify时两种数据库都校验证书和主机名，没有配置ca时使用系统的根证书
+type sqlTLS struct {
+	CA         string `json:"ca"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	ServerName string `json:"server_name"`
+	SkipVerify bool   `json:"skip_verify"`
+}
+
+// tls配置会改写的DSN参数，不能同时出现在params中
+var tlsParams = map[string][]string{
+	DB_TYPE_MYSQL:    {"tls"},
+	DB_TYPE_POSTGRES: {"sslrootcert", "sslcert", "sslkey"},
+}
+
+// 解析dbcfg中的params和tls
+// params的值可以是字符串、数字或者bool，拼到DSN时统一转成字符串并转义
+func parseDSNOptions(dbtype string, cfg_json *simplejson.Json) (map[string]string, *sqlTLS, error) {
+	var params map[string]string
+	if v, ok := cfg_json.CheckGet("params"); ok {
+		m, err := v.Map()
+		if err != nil {
+			return nil, nil, fmt.Errorf("params must be object")
+		}
+
+		params = make(map[string]string, len(m))
+		for key, val := range m {
+			switch val.(type) {
+			case string, json.Number, bool:
+				params[key] = fmt.Sprint(val)
+			default:
+				return nil, nil, fmt.Errorf("params %s must be string, number or bool", key)
+			}
+		}
+	}
+
+	var t *sqlTLS
+	if v, ok := cfg_json.CheckGet("tls"); ok {
+		data, err := v.MarshalJSON()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		t = &sqlTLS{}
+		if err := json.Unmarshal(data, t); err != nil {
+			return nil, nil, fmt.Errorf("tls err:%s", err)
+		}
+
+		if (t.Cert == "") != (t.Key == "") {
+			return nil, nil, fmt.Errorf("tls cert and key must be set together")
+		}
+
+		if dbtype == DB_TYPE_POSTGRES && t.ServerName != "" {
+			return nil, nil, fmt.Errorf("tls server_name not supported by postgres")
+		}
+
+		// lib/pq配置了sslrootcert时sslmode=require也会校验证书，skip_verify不会生效
+		if dbtype == DB_TYPE_POSTGRES && t.SkipVerify && t.CA != "" {
+			return nil, nil, fmt.Errorf("tls skip_verify and ca can not be set together for postgres")
+		}
+
+		for _, key := range tlsParams[dbtype] {
+			if _, ok := params[key]; ok {
+				return nil, nil, fmt.Errorf("params %s conflicts with tls", key)
+			}
+		}
+
+		// skip_verify为false时也可以用verify-ca，只校验证书不校验主机名
+		if mode, ok := params["sslmode"]; ok && dbtype == DB_TYPE_POSTGRES {
+			if mode != postgresSSLMode(t) && !(mode == "verify-ca" && !t.SkipVerify) {
+				return nil, nil, fmt.Errorf("params sslmode:%s conflicts with tls skip_verify:%v", mode, t.SkipVerify)
+			}
+		}
+	}
+
+	if dbtype == DB_TYPE_SQLITE && (params != nil || t != nil) {
+		return nil, nil, fmt.Errorf("params and tls not supported by sqlite3")
+	}
+
+	return params, t, nil
+}
+
+// tls配置对应的postgres sslmode，skip_verify时只加密不校验证书
+func postgresSSLMode(t *sqlTLS) string {
+	if t.SkipVerify {
+		return "require"
+	}
+	return "verify-full"
+}
+
+// 根据配置生成DSN，mysql配置了tls时需要先通过registerMysqlTLS注册
+func dataSourceName(info *dbSql, addr string) (string, error) {
+	return buildDSN(info, addr, info.passWord)
+}
+
+// 打日志用，密码替换为xxxxxx
+func redactedDSN(info *dbSql, addr string) string {
+	passwd := info.passWord
+	if passwd != "" {
+		passwd = "xxxxxx"
+	}
+
+	dsn, err := buildDSN(info, addr, passwd)
+	if err != nil {
+		return fmt.Sprintf("err:%s", err)
+	}
+	return dsn
+}
+
+func buildDSN(info *dbSql, addr, passwd string) (string, error) {
+	q := url.Values{}
+	for k, v := range info.params {
+		q.Set(k, v)
+	}
+
+	switch info.dbType {
+	case DB_TYPE_MYSQL:
+		if info.tls != nil {
+			if info.tlsName == "" {
+				return "", fmt.Errorf("mysql tls config not registered")
+			}
+			q.Set("tls", info.tlsName)
+		}
+
+		dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s", info.userName, passwd, addr, info.dbName)
+		if len(q) > 0 {
+			dsn += "?" + q.Encode()
+		}
+		return dsn, nil
+
+	case DB_TYPE_POSTGRES:
+		if t := info.tls; t != nil {
+			if t.CA != "" {
+				q.Set("sslrootcert", t.CA)
+			}
+			if t.Cert != "" {
+				q.Set("sslcert", t.Cert)
+				q.Set("sslkey", t.Key)
+			}
+
+			// params中的sslmode已经检查过和tls不矛盾
+			if q.Get("sslmode") == "" {
+				q.Set("sslmode", postgresSSLMode(t))
+			}
+		}
+
+		// 原来固定为disable，没有配置时保持不变
+		if q.Get("sslmode") == "" {
+			q.Set("sslmode", "disable")
+		}
+
+		u := &url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(info.userName, passwd),
+			Host:     addr,
+			Path:     "/" + info.dbName,
+			RawQuery: q.Encode(),
+		}
+		return u.String(), nil
+
+	case DB_TYPE_SQLITE:
+		if addr == SQLITE_MEMORY {
+			// 进程内dbname相同的内存库共享数据，所有连接关闭后数据丢失
+			return fmt.Sprintf("file:%s?mode=memory&cache=shared", info.dbName), nil
+		}
+		return addr, nil
+	}
+
+	return "", fmt.Errorf("dbtype:%s has no dsn", info.dbType)
+}
+
+var (
+	mysqlTLSMu sync.Mutex
+	// 注册名按配置内容生成，配置相同的instance共用，计数为0时从驱动中删除
+	mysqlTLSRefs = make(map[string]int)
+)
+
+// 按配置内容命名，创建instance时重新读取证书文件
+// 每次注册成功都要对应一次releaseMysqlTLS
+func registerMysqlTLS(t *sqlTLS) (string, error) {
+	data, _ := json.Marshal(t)
+	sum := sha1.Sum(data)
+	name := "dbrouter_" + hex.EncodeToString(sum[:8])
+
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.SkipVerify,
+	}
+
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return "", fmt.Errorf("tls ca err:%s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("tls ca:%s no certificate", t.CA)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return "", fmt.Errorf("tls cert err:%s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	mysqlTLSMu.Lock()
+	defer mysqlTLSMu.Unlock()
+
+	if err := mysql.RegisterTLSConfig(name, cfg); err != nil {
+		return "", err
+	}
+	mysqlTLSRefs[name]++
+
+	return name, nil
+}
+
+func releaseMysqlTLS(name string) {
+	mysqlTLSMu.Lock()
+	defer mysqlTLSMu.Unlock()
+
+	mysqlTLSRefs[name]--
+	if mysqlTLSRefs[name] <= 0 {
+		delete(mysqlTLSRefs, name)
+		mysql.DeregisterTLSConfig(name)
+	}
+}
@@ -7,28 +7,54 @@ package dbrouter
 
 import (
 	"fmt"
-	//"sync"
+	"hash/fnv"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MATCH_FULL  = "full"
+	MATCH_REGEX = "regex"
+	MATCH_HASH  = "hash"
+	MATCH_RANGE = "range"
 )
 
 type clsEntry struct {
 	// express to instances
 	full map[string]*dbExpress
-	regex map[string]*dbExpress
+	// regex按优先级从高到低排列，优先级相同的保持配置顺序
+	regex []*dbExpress
+	// hash prefix to bucket owners
+	hash map[string]*hashRing
+	// range prefix to ranges, sorted by low
+	ranges map[string][]*rangeExpress
 }
 
-// 没有考虑同步问题
+// 规则部分没有考虑同步问题
 // 目前只支持初始化一次加载完成
-// 构建完成后不能动态调整
+// 构建完成后不能动态调整，需要调整时通过Router.Reload整体替换
 type dbCluster struct {
 	// cluster to express
 	clusters map[string]*clsEntry
 
-	// cache table to instance
-	// map[string]string
-	//locCache map[string]string
+	// cache cluster/table to lookup, 只缓存找到的
+	// 满了随机淘汰一个，规则有变化时清空
+	cacheMu  sync.RWMutex
+	locCache map[lookupKey]*dbLookupCfg
 }
 
+type lookupKey struct {
+	cluster string
+	table   string
+}
+
+// 路由缓存最多保存的表数
+const lookupCacheSize = 8192
+
 type dbExpress struct {
 	lookup *dbLookupCfg
 	reg *regexp.Regexp
@@ -38,27 +64,139 @@ func (m *dbExpress) String() string {
 	return fmt.Sprintf("look:%s reg:%s", m.lookup, m.reg)
 }
 
+// 必须全部匹配上
+func (m *dbExpress) fullMatch(table string) bool {
+	f := m.reg.FindString(table)
+	return f == table
+}
+
+// hash分片，同一个前缀下的表共用buckets个桶
+// 每个桶只能归属一条规则
+type hashRing struct {
+	buckets int
+	owners  []*dbExpress
+}
+
+func (m *hashRing) String() string {
+	return fmt.Sprintf("buckets:%d owners:%s", m.buckets, m.owners)
+}
+
+// range分片，prefix[low-high]，包含两端
+type rangeExpress struct {
+	lookup *dbLookupCfg
+	low    int64
+	high   int64
+}
+
+func (m *rangeExpress) String() string {
+	return fmt.Sprintf("look:%s low:%d high:%d", m.lookup, m.low, m.high)
+}
+
+// 解析 user[0-511] 格式的表达式
+func parseRange(express string) (prefix string, low, high int64, err error) {
+	i := strings.IndexByte(express, '[')
+	if i <= 0 || !strings.HasSuffix(express, "]") {
+		return "", 0, 0, fmt.Errorf("range express:%s format must be prefix[low-high]", express)
+	}
+
+	prefix = express[:i]
+	if c := prefix[len(prefix)-1]; c >= '0' && c <= '9' {
+		return "", 0, 0, fmt.Errorf("range express:%s prefix can not end with digit", express)
+	}
+
+	bounds := strings.Split(express[i+1:len(express)-1], "-")
+	if len(bounds) != 2 {
+		return "", 0, 0, fmt.Errorf("range express:%s format must be prefix[low-high]", express)
+	}
+
+	if low, err = strconv.ParseInt(bounds[0], 10, 64); err != nil || low < 0 {
+		return "", 0, 0, fmt.Errorf("range express:%s low bound invalid", express)
+	}
+
+	if high, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || high < low {
+		return "", 0, 0, fmt.Errorf("range express:%s high bound invalid", express)
+	}
+
+	return prefix, low, high, nil
+}
+
+// 表名拆成前缀和尾部数字，user012这种前导0的不认为是数字后缀
+func splitNumSuffix(table string) (string, int64, bool) {
+	i := len(table)
+	for i > 0 && table[i-1] >= '0' && table[i-1] <= '9' {
+		i--
+	}
+
+	if i == 0 || i == len(table) {
+		return "", 0, false
+	}
+
+	num := table[i:]
+	if len(num) > 1 && num[0] == '0' {
+		return "", 0, false
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return table[:i], n, true
+}
+
+// 表名的分片key只能是数字，如user123的key为123
+// 避免user_profile这种拼错的表名落到user的分片上
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// HashBucket 计算分片key落在哪个桶上
+// 算法固定为FNV-1a 32位哈希对桶数取模，各个服务按同样的方式计算可以得到相同的分布
+func HashBucket(key string, buckets int) int {
+	if buckets <= 0 {
+		return -1
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(buckets))
+}
+
 
 func (m *dbCluster) addInstance(cluster string, lcfg *dbLookupCfg) error {
+	defer m.resetCache()
+
 	if _, ok := m.clusters[cluster]; !ok {
 		m.clusters[cluster] = &clsEntry {
 			full: make(map[string]*dbExpress),
-			regex: make(map[string]*dbExpress),
+			hash: make(map[string]*hashRing),
+			ranges: make(map[string][]*rangeExpress),
 		}
 	}
 
 
 	match := lcfg.Match
-	if match == "full" {
+	if match == MATCH_FULL {
 		if m.clusters[cluster].full[lcfg.Express] != nil {
 			return fmt.Errorf("dup match full in cluster:%s express:%s", cluster, lcfg.Express)
 		}
 
 		m.clusters[cluster].full[lcfg.Express] = &dbExpress{lookup: lcfg}
 
-	} else if match == "regex" {
-		if m.clusters[cluster].regex[lcfg.Express] != nil {
-			return fmt.Errorf("dup match regex in cluster:%s express:%s", cluster, lcfg.Express)
+	} else if match == MATCH_REGEX {
+		for _, e := range m.clusters[cluster].regex {
+			if e.lookup.Express == lcfg.Express {
+				return fmt.Errorf("dup match regex in cluster:%s express:%s", cluster, lcfg.Express)
+			}
 		}
 
 
@@ -67,7 +205,13 @@ func (m *dbCluster) addInstance(cluster string, lcfg *dbLookupCfg) error {
 			return err
 		}
 
-		m.clusters[cluster].regex[lcfg.Express] = &dbExpress{lookup: lcfg, reg: reg}
+		m.clusters[cluster].addRegex(&dbExpress{lookup: lcfg, reg: reg})
+
+	} else if match == MATCH_HASH {
+		return m.addHash(cluster, lcfg)
+
+	} else if match == MATCH_RANGE {
+		return m.addRange(cluster, lcfg)
 
 	} else {
 		return fmt.Errorf("match type:%s not support", match)
@@ -76,6 +220,139 @@ func (m *dbCluster) addInstance(cluster string, lcfg *dbLookupCfg) error {
 	return nil
 }
 
+// 插入到第一个优先级更低的规则前面
+func (m *clsEntry) addRegex(exp *dbExpress) {
+	i := sort.Search(len(m.regex), func(i int) bool {
+		return m.regex[i].lookup.Priority < exp.lookup.Priority
+	})
+
+	m.regex = append(m.regex, nil)
+	copy(m.regex[i+1:], m.regex[i:])
+	m.regex[i] = exp
+}
+
+func (m *dbCluster) addHash(cluster string, lcfg *dbLookupCfg) error {
+	if lcfg.Buckets <= 0 {
+		return fmt.Errorf("hash buckets must > 0 in cluster:%s express:%s buckets:%d", cluster, lcfg.Express, lcfg.Buckets)
+	}
+
+	if len(lcfg.Slots) == 0 {
+		return fmt.Errorf("hash slots is empty in cluster:%s express:%s", cluster, lcfg.Express)
+	}
+
+	ring := m.clusters[cluster].hash[lcfg.Express]
+	if ring == nil {
+		ring = &hashRing{
+			buckets: lcfg.Buckets,
+			owners:  make([]*dbExpress, lcfg.Buckets),
+		}
+	} else if ring.buckets != lcfg.Buckets {
+		return fmt.Errorf("hash buckets mismatch in cluster:%s express:%s buckets:%d want:%d", cluster, lcfg.Express, lcfg.Buckets, ring.buckets)
+	}
+
+	// 先检查再占用，出错时不留下一半的规则
+	seen := make(map[int]bool)
+	for _, s := range lcfg.Slots {
+		if s < 0 || s >= ring.buckets {
+			return fmt.Errorf("hash slot out of range in cluster:%s express:%s slot:%d buckets:%d", cluster, lcfg.Express, s, ring.buckets)
+		}
+
+		if own := ring.owners[s]; own != nil {
+			return fmt.Errorf("dup hash slot in cluster:%s express:%s slot:%d instance:%s", cluster, lcfg.Express, s, own.lookup.Instance)
+		}
+
+		if seen[s] {
+			return fmt.Errorf("dup hash slot in cluster:%s express:%s slot:%d", cluster, lcfg.Express, s)
+		}
+		seen[s] = true
+	}
+
+	exp := &dbExpress{lookup: lcfg}
+	for _, s := range lcfg.Slots {
+		ring.owners[s] = exp
+	}
+
+	m.clusters[cluster].hash[lcfg.Express] = ring
+	return nil
+}
+
+func (m *dbCluster) addRange(cluster string, lcfg *dbLookupCfg) error {
+	prefix, low, high, err := parseRange(lcfg.Express)
+	if err != nil {
+		return err
+	}
+
+	rgs := m.clusters[cluster].ranges[prefix]
+	// 第一个high>=low的区间，如果和新区间有交叠就冲突
+	i := sort.Search(len(rgs), func(i int) bool { return rgs[i].high >= low })
+	if i < len(rgs) && rgs[i].low <= high {
+		return fmt.Errorf("range overlap in cluster:%s express:%s with:%s", cluster, lcfg.Express, rgs[i].lookup.Express)
+	}
+
+	rgs = append(rgs, nil)
+	copy(rgs[i+1:], rgs[i:])
+	rgs[i] = &rangeExpress{lookup: lcfg, low: low, high: high}
+
+	m.clusters[cluster].ranges[prefix] = rgs
+	return nil
+}
+
+// 返回没有规则认领的hash桶，cluster -> express -> slots
+func (m *dbCluster) unownedSlots() map[string]map[string][]int {
+	res := make(map[string]map[string][]int)
+	for c, exp := range m.clusters {
+		for prefix, ring := range exp.hash {
+			for i, own := range ring.owners {
+				if own == nil {
+					if res[c] == nil {
+						res[c] = make(map[string][]int)
+					}
+					res[c][prefix] = append(res[c][prefix], i)
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+func (m *dbCluster) resetCache() {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	m.locCache = nil
+}
+
+func (m *dbCluster) getCache(key lookupKey) (*dbLookupCfg, bool) {
+	m.cacheMu.RLock()
+	defer m.cacheMu.RUnlock()
+
+	lk, ok := m.locCache[key]
+	return lk, ok
+}
+
+func (m *dbCluster) setCache(key lookupKey, lk *dbLookupCfg) {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	if m.locCache == nil {
+		m.locCache = make(map[lookupKey]*dbLookupCfg)
+	}
+
+	if _, ok := m.locCache[key]; ok {
+		return
+	}
+
+	// map遍历顺序随机，删掉遍历到的第一个
+	if len(m.locCache) >= lookupCacheSize {
+		for k := range m.locCache {
+			delete(m.locCache, k)
+			break
+		}
+	}
+	m.locCache[key] = lk
+}
+
 func (m *dbCluster) getLookup(cluster string, table string) *dbLookupCfg {
 
 
@@ -90,19 +367,90 @@ func (m *dbCluster) getLookup(cluster string, table string) *dbLookupCfg {
 		return en.lookup
 	}
 
-	// 正则
-	for _, e := range exp.regex {
-		// 必须全部匹配上
-		f := e.reg.FindString(table)
-		//fmt.Println("DDDDDD", f, table, e)
-		if table == f {
-			return e.lookup
+	key := lookupKey{cluster, table}
+	if lk, ok := m.getCache(key); ok {
+		return lk
+	}
+
+	// 没找到的不缓存，避免随意的表名把缓存占满
+	lk := exp.findLookup(table, isDigits)
+	if lk != nil {
+		m.setCache(key, lk)
+	}
+	return lk
+}
+
+// 按redis key这种取值不受限的名字查找，不走缓存
+// hash规则前缀后面的部分不限制格式，如sess:后面的token
+func (m *dbCluster) getKeyLookup(cluster string, key string) *dbLookupCfg {
+	exp := m.clusters[cluster]
+	if exp == nil {
+		return nil
+	}
+
+	if en := exp.full[key]; en != nil {
+		return en.lookup
+	}
+
+	return exp.findLookup(key, func(s string) bool { return s != "" })
+}
+
+// 不走缓存，依次查找正则，range，hash
+// hashKey判断hash规则前缀后面的部分能否作为分片key
+func (m *clsEntry) findLookup(table string, hashKey func(string) bool) *dbLookupCfg {
+	// 正则，按优先级顺序第一个命中的生效
+	if e := m.firstRegex(table); e != nil {
+		return e.lookup
+	}
+
+	// range，按尾部数字二分查找
+	if prefix, n, ok := splitNumSuffix(table); ok {
+		rgs := m.ranges[prefix]
+		i := sort.Search(len(rgs), func(i int) bool { return rgs[i].high >= n })
+		if i < len(rgs) && rgs[i].low <= n {
+			return rgs[i].lookup
+		}
+	}
+
+	// hash，去掉前缀后的部分作为分片key，多个前缀都能匹配时取最长的
+	prefix := ""
+	for p := range m.hash {
+		if len(p) > len(prefix) && strings.HasPrefix(table, p) && hashKey(table[len(p):]) {
+			prefix = p
 		}
 	}
 
+	if prefix != "" {
+		return m.hash[prefix].lookup(table[len(prefix):])
+	}
+
 	return nil
 }
 
+// 使用调用方提供的分片key查找，prefix为hash规则的express
+func (m *dbCluster) getLookupByKey(cluster, prefix, key string) *dbLookupCfg {
+	exp := m.clusters[cluster]
+	if exp == nil {
+		return nil
+	}
+
+	ring := exp.hash[prefix]
+	if ring == nil {
+		return nil
+	}
+
+	return ring.lookup(key)
+}
+
+func (m *hashRing) lookup(key string) *dbLookupCfg {
+	own := m.owners[HashBucket(key, m.buckets)]
+	if own == nil {
+		return nil
+	}
+
+	return own.lookup
+}
+
 func (m *dbCluster) getInstance(cluster string, table string) string {
 	if lk := m.getLookup(cluster, table); lk != nil {
 		return lk.Instance
@@ -111,3 +459,364 @@ func (m *dbCluster) getInstance(cluster string, table string) string {
 	}
 
 }
+
+// 所有表都要路由到同一个instance，否则返回的错误中列出每个表的instance
+func (m *dbCluster) getSameInstance(cluster string, tables []string) (string, error) {
+	return m.sameInstance(cluster, tables, func(i int, table string) string {
+		return m.getInstance(cluster, table)
+	})
+}
+
+// tables[0]只按key查找hash规则，其他的表是hash规则的前缀时按key查找，否则按表名查找
+func (m *dbCluster) getSameInstanceByKey(cluster, key string, tables []string) (string, error) {
+	return m.sameInstance(cluster, tables, func(i int, table string) string {
+		if ins := m.getInstanceByKey(cluster, table, key); ins != "" || i == 0 {
+			return ins
+		}
+		return m.getInstance(cluster, table)
+	})
+}
+
+func (m *dbCluster) sameInstance(cluster string, tables []string, route func(int, string) string) (string, error) {
+	var name string
+	routes := make([]string, 0, len(tables))
+	conflict := false
+	for i, table := range tables {
+		ins := route(i, table)
+		if ins == "" {
+			return "", fmt.Errorf("cluster instance not find: cluster:%s table:%s", cluster, table)
+		}
+
+		if name == "" {
+			name = ins
+		} else if ins != name {
+			conflict = true
+		}
+		routes = append(routes, table+"->"+ins)
+	}
+
+	if conflict {
+		return "", fmt.Errorf("cluster:%s tables on different instances: %s", cluster, strings.Join(routes, ","))
+	}
+
+	return name, nil
+}
+
+// 路由到同一个instance的表
+type insTables struct {
+	instance string
+	tables   []string
+}
+
+// 按instance分组，组的顺序和组内表的顺序都按tables中第一次出现的顺序
+func (m *dbCluster) groupByInstance(cluster string, tables []string) ([]*insTables, error) {
+	var groups []*insTables
+	idx := make(map[string]*insTables)
+	for _, table := range tables {
+		ins := m.getInstance(cluster, table)
+		if ins == "" {
+			return nil, fmt.Errorf("cluster instance not find: cluster:%s table:%s", cluster, table)
+		}
+
+		g := idx[ins]
+		if g == nil {
+			g = &insTables{instance: ins}
+			idx[ins] = g
+			groups = append(groups, g)
+		}
+		g.tables = append(g.tables, table)
+	}
+
+	return groups, nil
+}
+
+// 一个表被多条规则命中，并且路由到不同的instance
+// win为实际生效的规则
+type dbAmbiguity struct {
+	cluster string
+	table   string
+	win     *dbLookupCfg
+	lose    *dbLookupCfg
+}
+
+func (m *dbAmbiguity) String() string {
+	return fmt.Sprintf("cluster:%s table:%s match:[%s] and:[%s] use:%s", m.cluster, m.table, m.win, m.lose, m.win.Instance)
+}
+
+// 尽力检查规则之间的交叠，正则交叠没法精确判断
+// 这里从每条规则生成一批样例表名，拿去给其他规则匹配
+// 只能发现样例覆盖到的交叠，没有报告不代表规则之间没有交叠
+func (m *dbCluster) ambiguities() []*dbAmbiguity {
+	var res []*dbAmbiguity
+
+	cls := make([]string, 0, len(m.clusters))
+	for c := range m.clusters {
+		cls = append(cls, c)
+	}
+	sort.Strings(cls)
+
+	for _, c := range cls {
+		exp := m.clusters[c]
+
+		samples := make([][]string, len(exp.regex))
+		for i, e := range exp.regex {
+			samples[i] = regexSamples(e.lookup.Express)
+		}
+
+		// 每一对路由到不同instance的规则，找一个两边都能匹配的表名
+		for j, e := range exp.regex {
+			for i, w := range exp.regex[:j] {
+				if w.lookup.Instance == e.lookup.Instance {
+					continue
+				}
+
+				table, ok := exp.overlap(w, e, samples[i], samples[j])
+				if !ok {
+					continue
+				}
+
+				if win := exp.firstRegex(table); win.lookup.Instance != e.lookup.Instance {
+					res = append(res, &dbAmbiguity{cluster: c, table: table, win: win.lookup, lose: e.lookup})
+				}
+			}
+		}
+
+		// range和hash的样例表名被正则抢走
+		var others []*dbLookupCfg
+		var tables []string
+		for prefix, rgs := range exp.ranges {
+			for _, r := range rgs {
+				others = append(others, r.lookup)
+				tables = append(tables, fmt.Sprintf("%s%d", prefix, r.low))
+				others = append(others, r.lookup)
+				tables = append(tables, fmt.Sprintf("%s%d", prefix, r.high))
+			}
+		}
+
+		for prefix, ring := range exp.hash {
+			for i := 0; i < ring.buckets; i++ {
+				key := strconv.Itoa(i)
+				if lk := ring.lookup(key); lk != nil {
+					others = append(others, lk)
+					tables = append(tables, prefix+key)
+				}
+			}
+		}
+
+		for i, table := range tables {
+			if exp.full[table] != nil {
+				continue
+			}
+
+			if w := exp.firstRegex(table); w != nil && w.lookup.Instance != others[i].Instance {
+				res = append(res, &dbAmbiguity{cluster: c, table: table, win: w.lookup, lose: others[i]})
+			}
+		}
+	}
+
+	return res
+}
+
+func (m *clsEntry) overlap(a, b *dbExpress, samples ...[]string) (string, bool) {
+	for _, ss := range samples {
+		for _, table := range ss {
+			if m.full[table] == nil && a.fullMatch(table) && b.fullMatch(table) {
+				return table, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+func (m *clsEntry) firstRegex(table string) *dbExpress {
+	for _, e := range m.regex {
+		if e.fullMatch(table) {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// 每个节点最多生成的样例数
+const regexSampleLimit = 64
+
+func regexSamples(express string) []string {
+	re, err := syntax.Parse(express, syntax.POSIX)
+	if err != nil {
+		return nil
+	}
+
+	return sampleRegex(re.Simplify())
+}
+
+func sampleRegex(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+
+	case syntax.OpCharClass:
+		// 每个区间取首尾和中间
+		var res []string
+		for i := 0; i+1 < len(re.Rune) && len(res) < regexSampleLimit; i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			res = append(res, string(lo))
+			if hi != lo {
+				res = append(res, string(hi))
+			}
+			if mid := lo + (hi-lo)/2; mid != lo && mid != hi {
+				res = append(res, string(mid))
+			}
+		}
+		return res
+
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return []string{"a", "0", "_"}
+
+	case syntax.OpCapture:
+		return sampleRegex(re.Sub[0])
+
+	case syntax.OpStar:
+		return sampleRepeat(sampleRegex(re.Sub[0]), 0, 2)
+
+	case syntax.OpPlus:
+		return sampleRepeat(sampleRegex(re.Sub[0]), 1, 2)
+
+	case syntax.OpQuest:
+		return sampleRepeat(sampleRegex(re.Sub[0]), 0, 1)
+
+	case syntax.OpRepeat:
+		max := re.Max
+		if max < 0 || max > re.Min+1 {
+			max = re.Min + 1
+		}
+		return sampleRepeat(sampleRegex(re.Sub[0]), re.Min, max)
+
+	case syntax.OpConcat:
+		res := []string{""}
+		for _, sub := range re.Sub {
+			res = sampleProduct(res, sampleRegex(sub))
+		}
+		return res
+
+	case syntax.OpAlternate:
+		var res []string
+		for _, sub := range re.Sub {
+			res = append(res, sampleRegex(sub)...)
+		}
+		if len(res) > regexSampleLimit {
+			res = res[:regexSampleLimit]
+		}
+		return res
+
+	default:
+		// 空匹配，行首行尾等
+		return []string{""}
+	}
+}
+
+func sampleRepeat(sub []string, min, max int) []string {
+	var res []string
+
+	cur := []string{""}
+	for i := 0; i < min; i++ {
+		cur = sampleProduct(cur, sub)
+	}
+
+	for i := min; i <= max; i++ {
+		res = append(res, cur...)
+		cur = sampleProduct(cur, sub)
+	}
+
+	if len(res) > regexSampleLimit {
+		res = res[:regexSampleLimit]
+	}
+	return res
+}
+
+func sampleProduct(a, b []string) []string {
+	var res []string
+	for _, x := range a {
+		for _, y := range b {
+			if len(res) >= regexSampleLimit {
+				return res
+			}
+			res = append(res, x+y)
+		}
+	}
+	return res
+}
+
+func (m *dbCluster) getInstanceByKey(cluster, prefix, key string) string {
+	if lk := m.getLookupByKey(cluster, prefix, key); lk != nil {
+		return lk.Instance
+	} else {
+		return ""
+	}
+}
+
+// RuleInfo 一条路由规则，字段和配置中的lookup规则相同
+type RuleInfo struct {
+	Cluster  string `json:"cluster"`
+	Instance string `json:"instance"`
+	Match    string `json:"match"`
+	Express  string `json:"express"`
+	Buckets  int    `json:"buckets,omitempty"`
+	Slots    []int  `json:"slots,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+func newRuleInfo(cluster string, lk *dbLookupCfg) RuleInfo {
+	return RuleInfo{
+		Cluster:  cluster,
+		Instance: lk.Instance,
+		Match:    lk.Match,
+		Express:  lk.Express,
+		Buckets:  lk.Buckets,
+		// 复制一份，调用方修改不影响路由
+		Slots:    append([]int(nil), lk.Slots...),
+		Priority: lk.Priority,
+	}
+}
+
+// 所有生效的规则，按cluster排序，cluster内按full、regex、range、hash的查找顺序
+// instance不为空时只返回指向它的规则
+func (m *dbCluster) rules(instance string) []RuleInfo {
+	var res []RuleInfo
+	add := func(cluster string, lk *dbLookupCfg) {
+		if instance == "" || lk.Instance == instance {
+			res = append(res, newRuleInfo(cluster, lk))
+		}
+	}
+
+	for _, c := range sortedKeys(m.clusters) {
+		exp := m.clusters[c]
+		for _, e := range sortedKeys(exp.full) {
+			add(c, exp.full[e].lookup)
+		}
+
+		for _, e := range exp.regex {
+			add(c, e.lookup)
+		}
+
+		for _, prefix := range sortedKeys(exp.ranges) {
+			for _, r := range exp.ranges[prefix] {
+				add(c, r.lookup)
+			}
+		}
+
+		// 一条hash规则认领多个桶，按第一个桶的顺序输出一次
+		for _, prefix := range sortedKeys(exp.hash) {
+			seen := make(map[*dbLookupCfg]bool)
+			for _, own := range exp.hash[prefix].owners {
+				if own != nil && !seen[own.lookup] {
+					seen[own.lookup] = true
+					add(c, own.lookup)
+				}
+			}
+		}
+	}
+
+	return res
+}
@@ -7,6 +7,7 @@ package dbrouter
 
 
 import (
+	"fmt"
 	"log"
 	"testing"
 )
@@ -40,25 +41,25 @@ func clustertest(t *testing.T) {
 
 	cluster := "account"
 
-	err := dbs.addInstance(cluster, &dbLookupCfg{"user", "regex", "user[0-5]"})
+	err := dbs.addInstance(cluster, &dbLookupCfg{Instance: "user", Match: "regex", Express: "user[0-5]"})
 	if err != nil {
 		t.Errorf("err add:%s", err)
 	}
 
-	err = dbs.addInstance(cluster, &dbLookupCfg{"auth", "regex", "auth[0-9]+"})
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "auth", Match: "regex", Express: "auth[0-9]+"})
 	if err != nil {
 		t.Errorf("err add:%s", err)
 	}
 
 
-	err = dbs.addInstance(cluster, &dbLookupCfg{"aaafull", "full", "aaa"})
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "aaafull", Match: "full", Express: "aaa"})
 	if err != nil {
 		t.Errorf("err add:%s", err)
 	}
 
 
 
-	err = dbs.addInstance(cluster, &dbLookupCfg{"aaareg", "regex", "aaa[0-9]*"})
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "aaareg", Match: "regex", Express: "aaa[0-9]*"})
 	if err != nil {
 		t.Errorf("err add:%s", err)
 	}
@@ -85,3 +86,322 @@ func clustertest(t *testing.T) {
 	check_ins(t, dbs, cluster, "aaa0", "aaareg")
 
 }
+
+func TestHashBucket(t *testing.T) {
+	// 哈希算法是对外约定，结果不能变
+	cases := map[string]int{
+		"":      1,
+		"0":     3,
+		"1":     0,
+		"12345": 0,
+		"abc":   3,
+	}
+
+	for k, b := range cases {
+		if r := HashBucket(k, 4); r != b {
+			t.Errorf("hash bucket key:%s got:%d want:%d", k, r, b)
+		}
+	}
+
+	if r := HashBucket("abc", 0); r != -1 {
+		t.Errorf("hash bucket zero buckets got:%d", r)
+	}
+}
+
+func TestHashCluster(t *testing.T) {
+	dbs := &dbCluster{
+		clusters: make(map[string]*clsEntry),
+	}
+
+	cluster := "account"
+
+	err := dbs.addInstance(cluster, &dbLookupCfg{Instance: "ha", Match: "hash", Express: "user", Buckets: 4, Slots: []int{0, 1}})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "hb", Match: "hash", Express: "user", Buckets: 4, Slots: []int{2, 3}})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "ext", Match: "hash", Express: "user_ext", Buckets: 1, Slots: []int{0}})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	// 桶数不一致
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "hc", Match: "hash", Express: "user", Buckets: 8, Slots: []int{4}})
+	if err == nil {
+		t.Errorf("buckets mismatch should fail")
+	}
+
+	// 桶已经被占用
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "hc", Match: "hash", Express: "user", Buckets: 4, Slots: []int{3}})
+	if err == nil {
+		t.Errorf("dup slot should fail")
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "hc", Match: "hash", Express: "user", Buckets: 4, Slots: []int{4}})
+	if err == nil {
+		t.Errorf("slot out of range should fail")
+	}
+
+	for k, b := range map[string]int{"0": 3, "1": 0, "12345": 0} {
+		ins := "ha"
+		if b >= 2 {
+			ins = "hb"
+		}
+		check_ins(t, dbs, cluster, "user"+k, ins)
+
+		if r := dbs.getInstanceByKey(cluster, "user", k); r != ins {
+			t.Errorf("err by key:%s ins:%s res:%s", k, r, ins)
+		}
+	}
+
+	// 调用方提供的key不限制格式
+	if r := dbs.getInstanceByKey(cluster, "user", "abc"); r != "hb" {
+		t.Errorf("err by key:abc res:%s", r)
+	}
+
+	// 前缀后面不是纯数字的表名不路由
+	for _, table := range []string{"user", "userabc", "userx", "user_profile", "user12x", "user_ext"} {
+		check_ins(t, dbs, cluster, table, "")
+	}
+	check_ins(t, dbs, cluster, "user_ext0", "ext")
+
+	if len(dbs.unownedSlots()) != 0 {
+		t.Errorf("unexpected unowned slots:%v", dbs.unownedSlots())
+	}
+}
+
+func TestRangeCluster(t *testing.T) {
+	dbs := &dbCluster{
+		clusters: make(map[string]*clsEntry),
+	}
+
+	cluster := "account"
+
+	err := dbs.addInstance(cluster, &dbLookupCfg{Instance: "account_b", Match: "range", Express: "user[512-1023]"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "account_a", Match: "range", Express: "user[0-511]"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "member", Match: "range", Express: "member[0-9]"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	// 区间交叠
+	for _, exp := range []string{"user[511-512]", "user[100-200]", "user[1023-2000]", "user[0-0]"} {
+		err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "account_c", Match: "range", Express: exp})
+		if err == nil {
+			t.Errorf("overlap range should fail:%s", exp)
+		}
+	}
+
+	// 格式错误
+	for _, exp := range []string{"user", "[0-1]", "user[1-0]", "user[a-1]", "user[0-1", "user1[0-1]", "user[-1-2]"} {
+		err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "account_c", Match: "range", Express: exp})
+		if err == nil {
+			t.Errorf("bad range should fail:%s", exp)
+		}
+	}
+
+	check_ins(t, dbs, cluster, "user0", "account_a")
+	check_ins(t, dbs, cluster, "user511", "account_a")
+	check_ins(t, dbs, cluster, "user512", "account_b")
+	check_ins(t, dbs, cluster, "user1023", "account_b")
+	check_ins(t, dbs, cluster, "user1024", "")
+	check_ins(t, dbs, cluster, "user01", "")
+	check_ins(t, dbs, cluster, "user", "")
+	check_ins(t, dbs, cluster, "member9", "member")
+	check_ins(t, dbs, cluster, "member10", "")
+}
+
+func TestRegexPriority(t *testing.T) {
+	dbs := &dbCluster{
+		clusters: make(map[string]*clsEntry),
+	}
+
+	cluster := "account"
+
+	err := dbs.addInstance(cluster, &dbLookupCfg{Instance: "auth", Match: "regex", Express: "auth[0-9]+"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "auth_old", Match: "regex", Express: "auth1[0-9]*"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "auth_new", Match: "regex", Express: "auth2[0-9]*", Priority: 10})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "auth", Match: "regex", Express: "auth[0-9]+"})
+	if err == nil {
+		t.Errorf("dup regex should fail")
+	}
+
+	// 配置顺序在前的先生效
+	for i := 0; i < 100; i++ {
+		check_ins(t, dbs, cluster, "auth1", "auth")
+		check_ins(t, dbs, cluster, "auth10", "auth")
+	}
+
+	// 优先级高的先生效
+	check_ins(t, dbs, cluster, "auth2", "auth_new")
+	check_ins(t, dbs, cluster, "auth29", "auth_new")
+	check_ins(t, dbs, cluster, "auth3", "auth")
+
+	amb := dbs.ambiguities()
+	log.Println("ambiguities", amb)
+
+	lose := make(map[string]string)
+	for _, a := range amb {
+		lose[a.lose.Express] = a.win.Express
+	}
+
+	if lose["auth1[0-9]*"] != "auth[0-9]+" {
+		t.Errorf("ambiguity auth1 not found:%v", amb)
+	}
+
+	if lose["auth[0-9]+"] != "auth2[0-9]*" {
+		t.Errorf("ambiguity auth2 not found:%v", amb)
+	}
+
+	if _, ok := lose["auth2[0-9]*"]; ok {
+		t.Errorf("highest priority rule can not lose:%v", amb)
+	}
+}
+
+func TestAmbiguityRange(t *testing.T) {
+	dbs := &dbCluster{
+		clusters: make(map[string]*clsEntry),
+	}
+
+	cluster := "account"
+
+	err := dbs.addInstance(cluster, &dbLookupCfg{Instance: "a", Match: "range", Express: "user[0-511]"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "b", Match: "regex", Express: "user[0-9]"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "a", Match: "regex", Express: "fuck[0-9]|fuck[0-9][0-9]|fuck[0-9][0-9]+"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	amb := dbs.ambiguities()
+	if len(amb) != 1 || amb[0].table != "user0" || amb[0].win.Instance != "b" {
+		t.Errorf("range ambiguity not found:%v", amb)
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	dbs := &dbCluster{
+		clusters: make(map[string]*clsEntry),
+	}
+
+	cluster := "account"
+
+	err := dbs.addInstance(cluster, &dbLookupCfg{Instance: "auth", Match: "regex", Express: "auth[0-9]+"})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	check_ins(t, dbs, cluster, "auth1", "auth")
+	check_ins(t, dbs, cluster, "user1", "")
+
+	if lk, ok := dbs.getCache(lookupKey{cluster, "auth1"}); !ok || lk.Instance != "auth" {
+		t.Errorf("auth1 not cached")
+	}
+
+	if _, ok := dbs.getCache(lookupKey{cluster, "user1"}); ok {
+		t.Errorf("user1 miss cached")
+	}
+
+	if dbs.getKeyLookup(cluster, "auth2") == nil {
+		t.Errorf("auth2 key lookup fail")
+	}
+
+	if _, ok := dbs.getCache(lookupKey{cluster, "auth2"}); ok {
+		t.Errorf("auth2 key lookup cached")
+	}
+
+	// 规则变化后缓存失效
+	err = dbs.addInstance(cluster, &dbLookupCfg{Instance: "user", Match: "regex", Express: "user[0-9]+", Priority: 1})
+	if err != nil {
+		t.Errorf("err add:%s", err)
+	}
+
+	check_ins(t, dbs, cluster, "user1", "user")
+
+	for i := 0; i < lookupCacheSize+10; i++ {
+		dbs.getLookup(cluster, fmt.Sprintf("auth%d", i))
+	}
+
+	// 满了之后逐个淘汰，不整体清空
+	if n := len(dbs.locCache); n != lookupCacheSize {
+		t.Errorf("cache size:%d want:%d", n, lookupCacheSize)
+	}
+
+	last := fmt.Sprintf("auth%d", lookupCacheSize+9)
+	if _, ok := dbs.getCache(lookupKey{cluster, last}); !ok {
+		t.Errorf("%s not cached", last)
+	}
+}
+
+func benchCluster(b *testing.B) *dbCluster {
+	dbs := &dbCluster{
+		clusters: make(map[string]*clsEntry),
+	}
+
+	for i := 0; i < 50; i++ {
+		err := dbs.addInstance("account", &dbLookupCfg{Instance: fmt.Sprintf("ins%d", i), Match: "regex", Express: fmt.Sprintf("tb%d_[0-9]+", i)})
+		if err != nil {
+			b.Fatalf("err add:%s", err)
+		}
+	}
+
+	return dbs
+}
+
+func BenchmarkLookupNoCache(b *testing.B) {
+	dbs := benchCluster(b)
+	exp := dbs.clusters["account"]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if exp.findLookup("tb49_100", isDigits) == nil {
+			b.Fatalf("lookup fail")
+		}
+	}
+}
+
+func BenchmarkLookupCache(b *testing.B) {
+	dbs := benchCluster(b)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if dbs.getLookup("account", "tb49_100") == nil {
+				b.Error("lookup fail")
+				return
+			}
+		}
+	})
+}
@@ -1,12 +1,22 @@
 module github.com/shawnfeng/dbrouter
 
+go 1.18
+
 require (
 	github.com/bitly/go-simplejson v0.4.4-0.20140701141959-3378bdcb5ceb
-	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
+	github.com/go-redis/redis v6.15.1+incompatible
 	github.com/go-sql-driver/mysql v1.0.1-0.20160411075031-7ebe0a500653
 	github.com/jmoiron/sqlx v0.0.0-20170430194603-d9bd385d68c0
 	github.com/lib/pq v0.0.0-20170603225454-8837942c3e09
-	github.com/mattn/go-sqlite3 v1.10.0 // indirect
+	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/shawnfeng/sutil v1.0.6-0.20190612070047-afb054cc79dd
 	gopkg.in/mgo.v2 v2.0.0-20141107142503-e2e914857713
 )
+
+require (
+	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869 // indirect
+	github.com/shawnfeng/lumberjack.v2 v0.0.0-20181226094728-63d76296ede8 // indirect
+	go.uber.org/atomic v1.3.2 // indirect
+	go.uber.org/multierr v1.1.0 // indirect
+	go.uber.org/zap v1.9.1 // indirect
+)
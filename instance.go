@@ -2,33 +2,183 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-
 package dbrouter
 
 import (
-	//"sync"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
 )
 
+// Instance 一个数据库实例，由dbtype对应的Factory根据instances配置创建
+type Instance interface {
+	// 配置中的dbtype
+	Type() string
+	// 检查实例是否可用
+	Ping(ctx context.Context) error
+	// 释放所有连接，Router在实例被删除或者关闭时调用
+	Close() error
+}
+
+// Factory 根据dbname和dbcfg创建Instance，err为nil时Instance不能为nil
+type Factory func(dbname string, cfg json.RawMessage) (Instance, error)
 
-type dbInstance interface {
-	getType() string
+type driver struct {
+	factory Factory
+	// 只检查配置不建立连接，ValidateConfig使用，可以为空
+	check func(dbname string, cfg json.RawMessage) error
 }
 
-type dbInstanceManager struct {
-	instances map[string]dbInstance
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]*driver)
+)
+
+// Register 注册dbtype对应的Instance创建方式，重复注册或者factory为nil时panic
+// 一般在init中调用，之后配置中就可以使用这个dbtype
+func Register(dbtype string, factory Factory) {
+	registerDriver(dbtype, factory, nil)
+}
+
+func registerDriver(dbtype string, factory Factory, check func(dbname string, cfg json.RawMessage) error) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if factory == nil {
+		panic("dbrouter: Register factory is nil")
+	}
+
+	if er := checkVarname(dbtype); er != nil {
+		panic(fmt.Sprintf("dbrouter: Register dbtype:%s err:%s", dbtype, er))
+	}
+
+	if _, dup := drivers[dbtype]; dup {
+		panic("dbrouter: Register called twice for dbtype " + dbtype)
+	}
+
+	drivers[dbtype] = &driver{factory: factory, check: check}
+}
+
+func getDriver(dbtype string) *driver {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	return drivers[dbtype]
 }
 
+// instance连同创建它的配置，以及正在执行的查询计数
+// Reload时配置没变的instance会直接复用
+type insEntry struct {
+	ins Instance
+	cfg *dbInsCfg
+
+	mu       sync.Mutex
+	inflight int
+	closing  bool
+	drained  chan struct{}
+}
 
-func (m *dbInstanceManager) add(name string, ins dbInstance) {
+func newInsEntry(ins Instance, cfg *dbInsCfg) *insEntry {
+	return &insEntry{
+		ins:     ins,
+		cfg:     cfg,
+		drained: make(chan struct{}),
+	}
+}
+
+// 占用instance，正在关闭的返回false
+func (m *insEntry) acquire() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		return false
+	}
+
+	m.inflight++
+	return true
+}
+
+func (m *insEntry) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inflight--
+	if m.closing && m.inflight == 0 {
+		close(m.drained)
+	}
+}
+
+// 不再接受新的查询，返回的chan在正在执行的查询都结束后关闭
+func (m *insEntry) retire() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closing {
+		m.closing = true
+		if m.inflight == 0 {
+			close(m.drained)
+		}
+	}
+
+	return m.drained
+}
+
+func (m *insEntry) sameConfig(cfg *dbInsCfg) bool {
+	if m.cfg == nil || cfg == nil {
+		return false
+	}
+
+	if m.cfg.Dbtype != cfg.Dbtype || m.cfg.Dbname != cfg.Dbname {
+		return false
+	}
+
+	// 忽略空白字符的差异
+	var a, b bytes.Buffer
+	if json.Compact(&a, m.cfg.Dbcfg) != nil || json.Compact(&b, cfg.Dbcfg) != nil {
+		return false
+	}
+
+	return bytes.Equal(a.Bytes(), b.Bytes())
+}
+
+type dbInstanceManager struct {
+	instances map[string]*insEntry
+}
+
+func (m *dbInstanceManager) add(name string, ins *insEntry) {
 	m.instances[name] = ins
 }
 
+func (m *dbInstanceManager) get(name string) Instance {
+	if ins, ok := m.instances[name]; ok {
+		return ins.ins
+	}
+	return nil
+}
 
-func (m *dbInstanceManager) get(name string) dbInstance {
+func (m *dbInstanceManager) getEntry(name string) *insEntry {
 	ins, _ := m.instances[name]
 	return ins
 }
 
+// 查找并占用instance，用完需要调用release
+func (m *dbInstanceManager) acquire(name string) *insEntry {
+	ins := m.instances[name]
+	if ins == nil || !ins.acquire() {
+		return nil
+	}
 
+	return ins
+}
 
-
+// 关闭不是从old复用过来的instance
+func (m *dbInstanceManager) closeNew(old *dbInstanceManager) {
+	for name, e := range m.instances {
+		if e.ins != nil && (old == nil || old.getEntry(name) != e) {
+			e.ins.Close()
+		}
+	}
+}
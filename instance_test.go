@@ -0,0 +1,151 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type memInstance struct {
+	dbname string
+	closed int32
+}
+
+func (m *memInstance) Type() string {
+	return "memkv"
+}
+
+func (m *memInstance) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *memInstance) Close() error {
+	atomic.StoreInt32(&m.closed, 1)
+	return nil
+}
+
+func init() {
+	Register("memkv", func(dbname string, cfg json.RawMessage) (Instance, error) {
+		var c struct {
+			Fail bool `json:"fail"`
+		}
+		if err := json.Unmarshal(cfg, &c); err != nil {
+			return nil, err
+		}
+
+		if c.Fail {
+			return nil, fmt.Errorf("fail by config")
+		}
+
+		return &memInstance{dbname: dbname}, nil
+	})
+
+	Register("nilinstance", func(dbname string, cfg json.RawMessage) (Instance, error) {
+		return nil, nil
+	})
+}
+
+func TestRegister(t *testing.T) {
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("dup register should panic")
+			}
+		}()
+		Register(DB_TYPE_MYSQL, func(dbname string, cfg json.RawMessage) (Instance, error) { return nil, nil })
+	}()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("nil factory should panic")
+			}
+		}()
+		Register("nilfactory", nil)
+	}()
+
+	cfg := []byte(`{
+		"cluster": {"KV": [{"instance": "kv", "match": "regex", "express": "kv[0-9]+"}]},
+		"instances": {
+			"kv": {"dbtype": "memkv", "dbname": "kvdb", "dbcfg": {}},
+			"bad": {"dbtype": "memkv", "dbname": "kvdb", "dbcfg": {"fail": true}}
+		}
+	}`)
+
+	r, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+
+	var ins *memInstance
+	err = r.InstanceExec("KV", "kv1", func(i Instance) error {
+		if i.Type() != "memkv" {
+			return fmt.Errorf("type:%s", i.Type())
+		}
+		ins = i.(*memInstance)
+		return i.Ping(context.Background())
+	})
+	if err != nil {
+		t.Fatalf("exec err:%s", err)
+	}
+
+	if ins.dbname != "kvdb" {
+		t.Errorf("dbname:%s", ins.dbname)
+	}
+
+	if err := r.InstanceExec("KV", "nope", func(i Instance) error { return nil }); err == nil {
+		t.Errorf("not routed table should fail")
+	}
+
+	// 不检查dbcfg，只检查类型是否注册
+	issues, err := ValidateConfig(cfg)
+	if err != nil || len(issues) != 1 || issues[0].Path != "instances.bad" {
+		t.Errorf("validate issues:%v err:%v", issues, err)
+	}
+
+	if err := r.Reload([]byte(`{"instances": {}}`)); err != nil {
+		t.Fatalf("reload err:%s", err)
+	}
+
+	for i := 0; i < 100 && atomic.LoadInt32(&ins.closed) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&ins.closed) == 0 {
+		t.Errorf("removed instance not closed")
+	}
+}
+
+func TestRegisterNilInstance(t *testing.T) {
+	cfg := []byte(`{
+		"cluster": {"KV": [{"instance": "kv", "match": "regex", "express": "kv[0-9]+"}]},
+		"instances": {"kv": {"dbtype": "nilinstance", "dbname": "kvdb", "dbcfg": {}}}
+	}`)
+
+	_, err := NewRouterWithOptions(cfg, Options{Strict: true})
+	ce, ok := err.(*ConfigError)
+	if !ok || len(ce.Issues) == 0 || ce.Issues[0].Path != "instances.kv.dbcfg" {
+		t.Fatalf("nil instance err:%v", err)
+	}
+
+	// 非Strict跳过这个instance，Close不能panic
+	r, err := NewRouter(cfg)
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+
+	if r.dbIns.getEntry("kv") != nil {
+		t.Errorf("nil instance added")
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Errorf("close err:%s", err)
+	}
+}
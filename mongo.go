@@ -5,6 +5,8 @@
 package dbrouter
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"sync"
 	"time"
@@ -18,19 +20,87 @@ import (
 	"github.com/shawnfeng/sutil/stime"
 )
 
+func init() {
+	registerDriver(DB_TYPE_MONGO, func(dbname string, cfg json.RawMessage) (Instance, error) {
+		db, err := NewdbMongo(DB_TYPE_MONGO, dbname, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+
+	}, func(dbname string, cfg json.RawMessage) error {
+		// mongo在第一次查询时才连接
+		_, err := NewdbMongo(DB_TYPE_MONGO, dbname, cfg)
+		return err
+	})
+}
+
 type dbMongo struct {
 	dbType   string
 	dbName   string
 	dialInfo *mgo.DialInfo
+	// 按consistency下标，每个consistency单独Dial，有自己的连接池
+	opts [3]mongoOptions
 
 	sessMu  sync.RWMutex
 	session [3]*mgo.Session
 }
 
-func (m *dbMongo) getType() string {
+func (m *dbMongo) Type() string {
 	return m.dbType
 }
 
+// session的超时和连接池大小，默认值和原来写死的一致
+type mongoOptions struct {
+	syncTimeout   time.Duration
+	socketTimeout time.Duration
+	poolLimit     int
+}
+
+const (
+	DEFAULT_MONGO_SYNC_TIMEOUT   = time.Minute
+	DEFAULT_MONGO_SOCKET_TIMEOUT = time.Minute
+	DEFAULT_MONGO_POOL_LIMIT     = 512
+)
+
+var consistencyNames = map[string]mode{
+	"eventual":  eventual,
+	"monotonic": monotonic,
+	"strong":    strong,
+}
+
+// 解析sync_timeout(毫秒)、socket_timeout(毫秒)、pool_limit，没有配置的保持opts中的值
+// 超时为0表示不超时，pool_limit为0时使用mgo的默认值
+func parseMongoOptions(js *simplejson.Json, opts *mongoOptions) error {
+	durs := []struct {
+		key string
+		val *time.Duration
+	}{
+		{"sync_timeout", &opts.syncTimeout},
+		{"socket_timeout", &opts.socketTimeout},
+	}
+
+	for _, d := range durs {
+		if v, ok := js.CheckGet(d.key); ok {
+			t, err := v.Int64()
+			if err != nil || t < 0 {
+				return fmt.Errorf("%s must be int >= 0", d.key)
+			}
+			*d.val = time.Duration(t) * time.Millisecond
+		}
+	}
+
+	if v, ok := js.CheckGet("pool_limit"); ok {
+		n, err := v.Int()
+		if err != nil || n < 0 {
+			return fmt.Errorf("pool_limit must be int >= 0")
+		}
+		opts.poolLimit = n
+	}
+
+	return nil
+}
+
 func NewdbMongo(dbtype, dbname string, cfg []byte) (*dbMongo, error) {
 
 	cfg_json, err := simplejson.NewJson(cfg)
@@ -40,7 +110,7 @@ func NewdbMongo(dbtype, dbname string, cfg []byte) (*dbMongo, error) {
 
 	addrs, err := cfg_json.Get("addrs").StringArray()
 	if err != nil {
-		return nil, fmt.Errorf("instance db:%s type:%s config:% addrs err:%s", dbname, dbtype, cfg, err)
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s addrs err:%s", dbname, dbtype, cfg, err)
 	}
 
 	timeout := 5 * time.Second
@@ -51,20 +121,64 @@ func NewdbMongo(dbtype, dbname string, cfg []byte) (*dbMongo, error) {
 	user, _ := cfg_json.Get("user").String()
 	passwd, _ := cfg_json.Get("passwd").String()
 
-	info := &mgo.DialInfo{
+	base := mongoOptions{
+		syncTimeout:   DEFAULT_MONGO_SYNC_TIMEOUT,
+		socketTimeout: DEFAULT_MONGO_SOCKET_TIMEOUT,
+		poolLimit:     DEFAULT_MONGO_POOL_LIMIT,
+	}
+
+	if err := parseMongoOptions(cfg_json, &base); err != nil {
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s err:%s", dbname, dbtype, cfg, err)
+	}
+
+	// consistency中按eventual、monotonic、strong覆盖外层的配置
+	db := &dbMongo{
+		dbType: dbtype,
+		dbName: dbname,
+	}
+	for i := range db.opts {
+		db.opts[i] = base
+	}
+
+	if over, ok := cfg_json.CheckGet("consistency"); ok {
+		m, err := over.Map()
+		if err != nil {
+			return nil, fmt.Errorf("instance db:%s type:%s config:%s consistency must be object", dbname, dbtype, cfg)
+		}
+
+		for name := range m {
+			c, ok := consistencyNames[name]
+			if !ok {
+				return nil, fmt.Errorf("instance db:%s type:%s config:%s consistency:%s unknown", dbname, dbtype, cfg, name)
+			}
+
+			// 覆盖块里只能有超时和连接池的配置，避免拼写错误被忽略
+			keys, err := over.Get(name).Map()
+			if err != nil {
+				return nil, fmt.Errorf("instance db:%s type:%s config:%s consistency:%s must be object", dbname, dbtype, cfg, name)
+			}
+			for key := range keys {
+				if key != "sync_timeout" && key != "socket_timeout" && key != "pool_limit" {
+					return nil, fmt.Errorf("instance db:%s type:%s config:%s consistency:%s unknown key:%s", dbname, dbtype, cfg, name, key)
+				}
+			}
+
+			if err := parseMongoOptions(over.Get(name), &db.opts[c]); err != nil {
+				return nil, fmt.Errorf("instance db:%s type:%s config:%s consistency:%s err:%s", dbname, dbtype, cfg, name, err)
+			}
+		}
+	}
+
+	db.dialInfo = &mgo.DialInfo{
 		Addrs:     addrs,
 		Timeout:   timeout,
 		Database:  dbname,
 		Username:  user,
 		Password:  passwd,
-		PoolLimit: 512,
+		PoolLimit: base.poolLimit,
 	}
 
-	return &dbMongo{
-		dbType:   dbtype,
-		dbName:   dbname,
-		dialInfo: info,
-	}, nil
+	return db, nil
 
 }
 
@@ -76,21 +190,23 @@ const (
 	strong    mode = 2
 )
 
-func dialConsistency(info *mgo.DialInfo, consistency mode) (session *mgo.Session, err error) {
+func dialConsistency(info *mgo.DialInfo, consistency mode, opts mongoOptions) (session *mgo.Session, err error) {
 
 	// http://godoc.org/gopkg.in/mgo.v2#Dial
 	// This method is generally called just once for a given cluster.
 	// Further sessions to the same cluster are then established using the New or Copy methods on the obtained session.
 	// This will make them share the underlying cluster, and manage the pool of connections appropriately.
 	// Once the session is not useful anymore, Close must be called to release the resources appropriately.
-	session, err = mgo.DialWithInfo(info)
+	dinfo := *info
+	dinfo.PoolLimit = opts.poolLimit
+	session, err = mgo.DialWithInfo(&dinfo)
 	if err != nil {
 		return
 	}
 	// 看Dial内部的实现
-	session.SetSyncTimeout(1 * time.Minute)
+	session.SetSyncTimeout(opts.syncTimeout)
 	// 不设置这个在执行写入，表不存在时候会报 read tcp 127.0.0.1:27017: i/o timeout
-	session.SetSocketTimeout(1 * time.Minute)
+	session.SetSocketTimeout(opts.socketTimeout)
 
 	switch consistency {
 	case eventual:
@@ -143,7 +259,7 @@ func (m *dbMongo) initSession(consistency mode) (*mgo.Session, error) {
 	if m.session[consistency] != nil {
 		return m.session[consistency], nil
 	} else {
-		s, err := dialConsistency(m.dialInfo, consistency)
+		s, err := dialConsistency(m.dialInfo, consistency, m.opts[consistency])
 		if err != nil {
 			return nil, err
 		} else {
@@ -153,6 +269,38 @@ func (m *dbMongo) initSession(consistency mode) (*mgo.Session, error) {
 	}
 }
 
+func (m *dbMongo) Ping(ctx context.Context) error {
+	sess, err := m.getSession(strong)
+	if err != nil {
+		return err
+	}
+
+	s := sess.Copy()
+	defer s.Close()
+
+	if dl, ok := ctx.Deadline(); ok {
+		if left := time.Until(dl); m.opts[strong].socketTimeout == 0 || left < m.opts[strong].socketTimeout {
+			s.SetSocketTimeout(left)
+		}
+	}
+
+	return s.Ping()
+}
+
+func (m *dbMongo) Close() error {
+	m.sessMu.Lock()
+	defer m.sessMu.Unlock()
+
+	for i, s := range m.session {
+		if s != nil {
+			s.Close()
+			m.session[i] = nil
+		}
+	}
+
+	return nil
+}
+
 func (m *dbMongo) getSession(consistency mode) (*mgo.Session, error) {
 	if s := m.checkGetSession(consistency); s != nil {
 		return s, nil
@@ -161,11 +309,21 @@ func (m *dbMongo) getSession(consistency mode) (*mgo.Session, error) {
 	}
 }
 
-func (m *Router) mongoExec(consistency mode, cluster, table string, query func(*mgo.Collection) error) error {
+func (m *Router) mongoExec(ctx context.Context, consistency mode, cluster, table string, query func(*mgo.Collection) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	stall := stime.NewTimeStat()
 	st := stime.NewTimeStat()
 
-	ins_name := m.dbCls.getInstance(cluster, table)
+	ins_name, entry, err := m.acquireInstance(func(cls *dbCluster) string {
+		return cls.getInstance(cluster, table)
+	})
+	if err != nil {
+		return err
+	}
+
 	if ins_name == "" {
 		return fmt.Errorf("cluster instance not find: cluster:%s table:%s", cluster, table)
 	}
@@ -173,17 +331,18 @@ func (m *Router) mongoExec(consistency mode, cluster, table string, query func(*
 	durInsn := st.Duration()
 	st.Reset()
 
-	ins := m.dbIns.get(ins_name)
-	if ins == nil {
+	if entry == nil {
 		return fmt.Errorf("db instance not find: cluster:%s table:%s", cluster, table)
 	}
+	defer entry.release()
+	ins := entry.ins
 
 	durIns := st.Duration()
 	st.Reset()
 
 	db, ok := ins.(*dbMongo)
 	if !ok {
-		return fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, ins.getType())
+		return fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, ins.Type())
 	}
 
 	durInst := st.Duration()
@@ -195,7 +354,7 @@ func (m *Router) mongoExec(consistency mode, cluster, table string, query func(*
 	}
 
 	if sess == nil {
-		return fmt.Errorf("db instance session empty: cluster:%s table:%s type:%s", cluster, table, ins.getType())
+		return fmt.Errorf("db instance session empty: cluster:%s table:%s type:%s", cluster, table, ins.Type())
 	}
 
 	durSess := st.Duration()
@@ -203,6 +362,22 @@ func (m *Router) mongoExec(consistency mode, cluster, table string, query func(*
 
 	sessionCopy := sess.Copy()
 	defer sessionCopy.Close()
+
+	// mgo不支持取消，只能用ctx的deadline限制拷贝出来的session，不超过配置的超时
+	if dl, ok := ctx.Deadline(); ok {
+		left := time.Until(dl)
+		if left <= 0 {
+			return context.DeadlineExceeded
+		}
+
+		opts := db.opts[consistency]
+		if opts.syncTimeout == 0 || left < opts.syncTimeout {
+			sessionCopy.SetSyncTimeout(left)
+		}
+		if opts.socketTimeout == 0 || left < opts.socketTimeout {
+			sessionCopy.SetSocketTimeout(left)
+		}
+	}
 	c := sessionCopy.DB("").C(table)
 
 	durcopy := st.Duration()
@@ -218,13 +393,26 @@ func (m *Router) mongoExec(consistency mode, cluster, table string, query func(*
 }
 
 func (m *Router) MongoExecEventual(cluster, table string, query func(*mgo.Collection) error) error {
-	return m.mongoExec(eventual, cluster, table, query)
+	return m.mongoExec(context.Background(), eventual, cluster, table, query)
 }
 
 func (m *Router) MongoExecMonotonic(cluster, table string, query func(*mgo.Collection) error) error {
-	return m.mongoExec(monotonic, cluster, table, query)
+	return m.mongoExec(context.Background(), monotonic, cluster, table, query)
 }
 
 func (m *Router) MongoExecStrong(cluster, table string, query func(*mgo.Collection) error) error {
-	return m.mongoExec(strong, cluster, table, query)
+	return m.mongoExec(context.Background(), strong, cluster, table, query)
+}
+
+// MongoExecEventualContext ctx有deadline时，查询的socket和sync超时不超过deadline
+func (m *Router) MongoExecEventualContext(ctx context.Context, cluster, table string, query func(*mgo.Collection) error) error {
+	return m.mongoExec(ctx, eventual, cluster, table, query)
+}
+
+func (m *Router) MongoExecMonotonicContext(ctx context.Context, cluster, table string, query func(*mgo.Collection) error) error {
+	return m.mongoExec(ctx, monotonic, cluster, table, query)
+}
+
+func (m *Router) MongoExecStrongContext(ctx context.Context, cluster, table string, query func(*mgo.Collection) error) error {
+	return m.mongoExec(ctx, strong, cluster, table, query)
 }
@@ -0,0 +1,59 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMongoOptions(t *testing.T) {
+	db, err := NewdbMongo(DB_TYPE_MONGO, "tmongo", []byte(`{
+		"addrs": ["127.0.0.1:27017"],
+		"sync_timeout": 2000,
+		"pool_limit": 64,
+		"consistency": {
+			"strong": {"socket_timeout": 300, "pool_limit": 16},
+			"eventual": {"sync_timeout": 0}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("new mongo err:%s", err)
+	}
+
+	want := [3]mongoOptions{
+		eventual:  {syncTimeout: 0, socketTimeout: time.Minute, poolLimit: 64},
+		monotonic: {syncTimeout: 2 * time.Second, socketTimeout: time.Minute, poolLimit: 64},
+		strong:    {syncTimeout: 2 * time.Second, socketTimeout: 300 * time.Millisecond, poolLimit: 16},
+	}
+	if db.opts != want {
+		t.Errorf("mongo opts:%+v", db.opts)
+	}
+
+	if db.dialInfo.PoolLimit != 64 {
+		t.Errorf("dial pool limit:%d", db.dialInfo.PoolLimit)
+	}
+
+	// 没有配置时和原来写死的一致
+	db, err = NewdbMongo(DB_TYPE_MONGO, "tmongo", []byte(`{"addrs": ["127.0.0.1:27017"]}`))
+	if err != nil {
+		t.Fatalf("new mongo err:%s", err)
+	}
+	if db.opts[strong] != (mongoOptions{syncTimeout: time.Minute, socketTimeout: time.Minute, poolLimit: 512}) {
+		t.Errorf("default opts:%+v", db.opts[strong])
+	}
+
+	for _, cfg := range []string{
+		`{"addrs": ["127.0.0.1:27017"], "socket_timeout": -1}`,
+		`{"addrs": ["127.0.0.1:27017"], "pool_limit": "big"}`,
+		`{"addrs": ["127.0.0.1:27017"], "consistency": {"weak": {}}}`,
+		`{"addrs": ["127.0.0.1:27017"], "consistency": {"strong": {"socket_timout": 100}}}`,
+		`{"addrs": ["127.0.0.1:27017"], "consistency": []}`,
+	} {
+		if _, err := NewdbMongo(DB_TYPE_MONGO, "tmongo", []byte(cfg)); err == nil {
+			t.Errorf("config:%s should fail", cfg)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/go-redis/redis"
+
+	"github.com/shawnfeng/sutil/slog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+func init() {
+	registerDriver(DB_TYPE_REDIS, func(dbname string, cfg json.RawMessage) (Instance, error) {
+		db, err := NewdbRedis(DB_TYPE_REDIS, dbname, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+
+	}, func(dbname string, cfg json.RawMessage) error {
+		_, err := parsedbRedis(DB_TYPE_REDIS, dbname, cfg)
+		return err
+	})
+}
+
+// redis的dbname只作为标识，库的编号通过dbcfg中的db指定
+type dbRedis struct {
+	dbType string
+	dbName string
+	opts   *redis.Options
+	client *redis.Client
+}
+
+func (m *dbRedis) Type() string {
+	return m.dbType
+}
+
+func (m *dbRedis) Ping(ctx context.Context) error {
+	return m.client.WithContext(ctx).Ping().Err()
+}
+
+func (m *dbRedis) Close() error {
+	return m.client.Close()
+}
+
+// NewdbRedis 创建连接池，和mongo一样在第一次使用时才建立连接
+func NewdbRedis(dbtype, dbname string, cfg []byte) (*dbRedis, error) {
+	info, err := parsedbRedis(dbtype, dbname, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	info.client = redis.NewClient(info.opts)
+	return info, nil
+}
+
+// 时间配置的单位都是毫秒，没有配置的使用go-redis的默认值
+func parsedbRedis(dbtype, dbname string, cfg []byte) (*dbRedis, error) {
+	cfg_json, err := simplejson.NewJson(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s unmarshal err:%s", dbname, dbtype, cfg, err)
+	}
+
+	addrs, err := cfg_json.Get("addrs").StringArray()
+	if err != nil {
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s addrs err:%s", dbname, dbtype, cfg, err)
+	}
+
+	if len(addrs) != 1 {
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s len(addrs)!=1", dbname, dbtype, cfg)
+	}
+
+	passwd, _ := cfg_json.Get("passwd").String()
+
+	opts := &redis.Options{
+		Addr:     addrs[0],
+		Password: passwd,
+	}
+
+	ints := []struct {
+		key string
+		val *int
+	}{
+		{"db", &opts.DB},
+		{"pool_size", &opts.PoolSize},
+		{"min_idle", &opts.MinIdleConns},
+	}
+
+	for _, i := range ints {
+		if v, ok := cfg_json.CheckGet(i.key); ok {
+			n, err := v.Int()
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("instance db:%s type:%s config:%s %s must be int >= 0", dbname, dbtype, cfg, i.key)
+			}
+			*i.val = n
+		}
+	}
+
+	durs := []struct {
+		key string
+		val *time.Duration
+	}{
+		{"timeout", &opts.DialTimeout},
+		{"read_timeout", &opts.ReadTimeout},
+		{"write_timeout", &opts.WriteTimeout},
+		{"pool_timeout", &opts.PoolTimeout},
+		{"idle_timeout", &opts.IdleTimeout},
+		{"max_conn_age", &opts.MaxConnAge},
+	}
+
+	for _, d := range durs {
+		if v, ok := cfg_json.CheckGet(d.key); ok {
+			t, err := v.Int64()
+			if err != nil || t < 0 {
+				return nil, fmt.Errorf("instance db:%s type:%s config:%s %s must be int >= 0", dbname, dbtype, cfg, d.key)
+			}
+			*d.val = time.Duration(t) * time.Millisecond
+		}
+	}
+
+	return &dbRedis{
+		dbType: dbtype,
+		dbName: dbname,
+		opts:   opts,
+	}, nil
+}
+
+// RedisExec 和表一样，key通过cluster的规则找到redis实例
+// 统计按命中的规则记录，避免每个key一条统计
+func (m *Router) RedisExec(cluster, key string, query func(*redis.Client) error) error {
+	stall := stime.NewTimeStat()
+	st := stime.NewTimeStat()
+
+	var express string
+	ins_name, entry, err := m.acquireInstance(func(cls *dbCluster) string {
+		lk := cls.getKeyLookup(cluster, key)
+		if lk == nil {
+			return ""
+		}
+
+		express = lk.Express
+		return lk.Instance
+	})
+	if err != nil {
+		return err
+	}
+
+	if ins_name == "" {
+		return fmt.Errorf("cluster instance not find: cluster:%s key:%s", cluster, key)
+	}
+
+	durInsn := st.Duration()
+	st.Reset()
+
+	if entry == nil {
+		return fmt.Errorf("db instance not find: cluster:%s key:%s", cluster, key)
+	}
+	defer entry.release()
+	ins := entry.ins
+
+	db, ok := ins.(*dbRedis)
+	if !ok {
+		return fmt.Errorf("db instance type error: cluster:%s key:%s type:%s", cluster, key, ins.Type())
+	}
+
+	durInst := st.Duration()
+	st.Reset()
+
+	defer func() {
+		dur := st.Duration()
+		m.stat.IncQuery(cluster, express, stall.Duration())
+		slog.Tracef("[REDIS] cls:%s key:%s nmins:%d rins:%d query:%d", cluster, key, durInsn, durInst, dur)
+	}()
+
+	return query(db.client)
+}
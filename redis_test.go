@@ -0,0 +1,84 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestRedis(t *testing.T) {
+	cfg := []byte(`{
+		"cluster": {
+			"SESSION": [
+				{"instance": "sess_a", "match": "hash", "express": "sess:", "buckets": 2, "slots": [0]},
+				{"instance": "sess_b", "match": "hash", "express": "sess:", "buckets": 2, "slots": [1]}
+			]
+		},
+		"instances": {
+			"sess_a": {"dbtype": "redis", "dbname": "sess", "dbcfg": {"addrs": ["127.0.0.1:6379"], "db": 1, "pool_size": 16, "idle_timeout": 30000}},
+			"sess_b": {"dbtype": "redis", "dbname": "sess", "dbcfg": {"addrs": ["127.0.0.1:6380"], "db": 2, "read_timeout": 100}}
+		}
+	}`)
+
+	r, err := NewRouterWithOptions(cfg, Options{Strict: true})
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+
+	// sess:1 -> bucket 0, sess:0 -> bucket 1
+	var opts *redis.Options
+	err = r.RedisExec("SESSION", "sess:1", func(c *redis.Client) error {
+		opts = c.Options()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("redis exec err:%s", err)
+	}
+
+	if opts.Addr != "127.0.0.1:6379" || opts.DB != 1 || opts.PoolSize != 16 || opts.IdleTimeout != 30*time.Second {
+		t.Errorf("sess:1 options:%+v", opts)
+	}
+
+	err = r.RedisExec("SESSION", "sess:0", func(c *redis.Client) error {
+		opts = c.Options()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("redis exec err:%s", err)
+	}
+
+	if opts.Addr != "127.0.0.1:6380" || opts.DB != 2 || opts.ReadTimeout != 100*time.Millisecond {
+		t.Errorf("sess:0 options:%+v", opts)
+	}
+
+	if err := r.RedisExec("SESSION", "user:1", func(c *redis.Client) error { return nil }); err == nil {
+		t.Errorf("not routed key should fail")
+	}
+
+	found := false
+	for _, s := range r.StatInfo() {
+		if s.ClusterTable == "SESSION.sess:" && s.Count == 2 {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("redis stat not recorded:%v", r.StatInfo())
+	}
+
+	// redis key的分片部分不限制为数字
+	if err := r.RedisExec("SESSION", "sess:abc", func(c *redis.Client) error { return nil }); err != nil {
+		t.Errorf("sess:abc err:%s", err)
+	}
+
+	bad := []byte(`{"dbtype": "redis", "dbname": "sess", "dbcfg": {"addrs": ["127.0.0.1:6379"], "pool_size": "16"}}`)
+	issues, err := ValidateConfig([]byte(`{"instances": {"bad": ` + string(bad) + `}}`))
+	if err != nil || len(issues) != 1 || issues[0].Path != "instances.bad.dbcfg" {
+		t.Errorf("bad pool_size issues:%v err:%v", issues, err)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/shawnfeng/sutil/slog"
+)
+
+// 没有配置lag_interval时的探测间隔
+const DEFAULT_LAG_INTERVAL = time.Second
+
+type sqlReplica struct {
+	addr string
+	db   *DB
+	// 1为延迟超过阈值或者探测失败，只由prober修改
+	lagging int32
+}
+
+func (m *sqlReplica) healthy() bool {
+	return atomic.LoadInt32(&m.lagging) == 0
+}
+
+// 测量从库的复制延迟
+type lagMeasure func(ctx context.Context, db *DB) (time.Duration, error)
+
+func lagMeasureFor(dbtype string) lagMeasure {
+	switch dbtype {
+	case DB_TYPE_MYSQL:
+		return mysqlLag
+	case DB_TYPE_POSTGRES:
+		return postgresLag
+	}
+
+	return nil
+}
+
+// Seconds_Behind_Master为NULL表示复制已经停止
+func mysqlLag(ctx context.Context, db *DB) (time.Duration, error) {
+	rows, err := db.QueryxContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("not a replica")
+	}
+
+	status := make(map[string]interface{})
+	if err := rows.MapScan(status); err != nil {
+		return 0, err
+	}
+
+	var sec int64
+	switch v := status["Seconds_Behind_Master"].(type) {
+	case nil:
+		return 0, fmt.Errorf("replication stopped")
+	case int64:
+		sec = v
+	case []byte:
+		if sec, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, fmt.Errorf("Seconds_Behind_Master:%s err:%s", v, err)
+		}
+	default:
+		return 0, fmt.Errorf("Seconds_Behind_Master type:%T", v)
+	}
+
+	return time.Duration(sec) * time.Second, nil
+}
+
+func postgresLag(ctx context.Context, db *DB) (time.Duration, error) {
+	var version int
+	if err := db.GetContext(ctx, &version, "SELECT current_setting('server_version_num')::int"); err != nil {
+		return 0, err
+	}
+
+	var st pgReplayStatus
+	if err := db.QueryRowxContext(ctx, postgresLagQuery(version)).Scan(&st.caughtUp, &st.sec); err != nil {
+		return 0, err
+	}
+
+	return st.lag()
+}
+
+// 10之前的版本函数名是xlog
+// 9.6开始有pg_stat_wal_receiver，复制断开时收到的位置不再变化，不能算作追上
+func postgresLagQuery(version int) string {
+	receive, replay := "pg_last_wal_receive_lsn()", "pg_last_wal_replay_lsn()"
+	if version < 100000 {
+		receive, replay = "pg_last_xlog_receive_location()", "pg_last_xlog_replay_location()"
+	}
+
+	caughtUp := receive + " = " + replay
+	if version >= 90600 {
+		caughtUp += " AND EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming')"
+	}
+
+	return fmt.Sprintf("SELECT %s, EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())", caughtUp)
+}
+
+type pgReplayStatus struct {
+	// 收到的WAL都已经回放
+	caughtUp sql.NullBool
+	// 距离最后回放的事务提交的秒数
+	sec sql.NullFloat64
+}
+
+// 主库空闲时最后回放的时间不再更新，追上的从库按没有延迟处理
+func (m pgReplayStatus) lag() (time.Duration, error) {
+	if m.caughtUp.Valid && m.caughtUp.Bool {
+		return 0, nil
+	}
+
+	if !m.sec.Valid {
+		return 0, fmt.Errorf("no replay timestamp")
+	}
+
+	return time.Duration(m.sec.Float64 * float64(time.Second)), nil
+}
+
+// 定期探测从库延迟，超过maxLag或者探测失败的从库不参与读查询
+type lagProber struct {
+	ins      *dbSql
+	maxLag   time.Duration
+	interval time.Duration
+	measure  lagMeasure
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newLagProber(ins *dbSql, measure lagMeasure) *lagProber {
+	interval := ins.lagInterval
+	if interval <= 0 {
+		interval = DEFAULT_LAG_INTERVAL
+	}
+
+	return &lagProber{
+		ins:      ins,
+		maxLag:   ins.maxLag,
+		interval: interval,
+		measure:  measure,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (m *lagProber) start() {
+	go func() {
+		defer close(m.done)
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			m.probe()
+
+			select {
+			case <-ticker.C:
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (m *lagProber) close() {
+	close(m.stop)
+	<-m.done
+}
+
+func (m *lagProber) probe() {
+	fun := "lagProber.probe -->"
+
+	for _, r := range m.ins.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+		lag, err := m.measure(ctx, r.db)
+		cancel()
+
+		lagging := err != nil || lag > m.maxLag
+		if lagging == !r.healthy() {
+			continue
+		}
+
+		if lagging {
+			atomic.StoreInt32(&r.lagging, 1)
+			atomic.AddInt32(&m.ins.lagging, 1)
+			slog.Warnf("%s db:%s replica:%s lagging lag:%s max:%s err:%v", fun, m.ins.dbName, r.addr, lag, m.maxLag, err)
+		} else {
+			atomic.StoreInt32(&r.lagging, 0)
+			atomic.AddInt32(&m.ins.lagging, -1)
+			slog.Infof("%s db:%s replica:%s recovered lag:%s", fun, m.ins.dbName, r.addr, lag)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLagProber(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+
+	dbsql := addSqliteReplicas(t, r, dir, "r1.db", "r2.db")
+	dbsql.maxLag = time.Second
+
+	var mu sync.Mutex
+	lags := map[string]time.Duration{}
+	fails := map[string]bool{}
+	measure := func(ctx context.Context, db *DB) (time.Duration, error) {
+		f := dbfile(t, db)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if fails[f] {
+			return 0, fmt.Errorf("replication stopped")
+		}
+		return lags[f], nil
+	}
+
+	set := func(lag map[string]time.Duration, fail map[string]bool) {
+		mu.Lock()
+		lags, fails = lag, fail
+		mu.Unlock()
+	}
+
+	reads := func() map[string]int {
+		got := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			err := r.SqlExecRead(context.Background(), "ACCOUNT", func(db *DB, tables []interface{}) error {
+				got[dbfile(t, db)]++
+				return nil
+			}, "user11")
+			if err != nil {
+				t.Fatalf("read err:%s", err)
+			}
+		}
+		return got
+	}
+
+	p := newLagProber(dbsql, measure)
+
+	// r1延迟超过阈值
+	set(map[string]time.Duration{"r1.db": 2 * time.Second, "r2.db": 100 * time.Millisecond}, nil)
+	p.probe()
+	if got := reads(); got["r2.db"] != 4 {
+		t.Errorf("r1 lagging reads:%v", got)
+	}
+
+	// 都不可用时读主库
+	set(map[string]time.Duration{"r1.db": 2 * time.Second}, map[string]bool{"r2.db": true})
+	p.probe()
+	if got := reads(); got["account.db"] != 4 {
+		t.Errorf("all lagging reads:%v", got)
+	}
+
+	// 主库空闲，最后回放的时间很久以前，但是从库已经追上
+	idle, err := pgReplayStatus{
+		caughtUp: sql.NullBool{Bool: true, Valid: true},
+		sec:      sql.NullFloat64{Float64: 3600, Valid: true},
+	}.lag()
+	if err != nil || idle != 0 {
+		t.Fatalf("idle primary lag:%s err:%v", idle, err)
+	}
+
+	set(map[string]time.Duration{"r1.db": idle, "r2.db": 2 * time.Second}, nil)
+	p.probe()
+	if got := reads(); got["r1.db"] != 4 {
+		t.Errorf("idle primary reads:%v", got)
+	}
+
+	// 恢复
+	set(nil, nil)
+	p.probe()
+	if got := reads(); got["r1.db"] != 2 || got["r2.db"] != 2 {
+		t.Errorf("recovered reads:%v", got)
+	}
+
+	// 后台探测，Close时停止
+	dbsql.lagInterval = 5 * time.Millisecond
+	set(map[string]time.Duration{"r1.db": 2 * time.Second}, nil)
+	dbsql.prober = newLagProber(dbsql, measure)
+	dbsql.prober.start()
+
+	deadline := time.Now().Add(time.Second)
+	for dbsql.replicas[0].healthy() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if dbsql.replicas[0].healthy() {
+		t.Errorf("background prober did not mark r1 lagging")
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Errorf("close err:%s", err)
+	}
+
+	select {
+	case <-dbsql.prober.done:
+	default:
+		t.Errorf("prober not stopped")
+	}
+}
+
+func TestPostgresLag(t *testing.T) {
+	cases := []struct {
+		st   pgReplayStatus
+		lag  time.Duration
+		fail bool
+	}{
+		// 追上了，不管最后回放的时间
+		{pgReplayStatus{sql.NullBool{Bool: true, Valid: true}, sql.NullFloat64{Float64: 3600, Valid: true}}, 0, false},
+		{pgReplayStatus{sql.NullBool{Bool: true, Valid: true}, sql.NullFloat64{}}, 0, false},
+		// 没有追上或者复制断开，按最后回放的时间
+		{pgReplayStatus{sql.NullBool{Bool: false, Valid: true}, sql.NullFloat64{Float64: 2.5, Valid: true}}, 2500 * time.Millisecond, false},
+		{pgReplayStatus{sql.NullBool{}, sql.NullFloat64{Float64: 1, Valid: true}}, time.Second, false},
+		{pgReplayStatus{sql.NullBool{Bool: false, Valid: true}, sql.NullFloat64{}}, 0, true},
+	}
+
+	for i, c := range cases {
+		lag, err := c.st.lag()
+		if lag != c.lag || (err != nil) != c.fail {
+			t.Errorf("case:%d lag:%s err:%v", i, lag, err)
+		}
+	}
+
+	for version, want := range map[int][]string{
+		150000: {"pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn()", "pg_stat_wal_receiver"},
+		90600:  {"pg_last_xlog_receive_location() = pg_last_xlog_replay_location()", "pg_stat_wal_receiver"},
+		90500:  {"pg_last_xlog_receive_location() = pg_last_xlog_replay_location()"},
+	} {
+		q := postgresLagQuery(version)
+		for _, w := range want {
+			if !strings.Contains(q, w) {
+				t.Errorf("version:%d query:%s want:%s", version, q, w)
+			}
+		}
+
+		if version < 90600 && strings.Contains(q, "pg_stat_wal_receiver") {
+			t.Errorf("version:%d query:%s", version, q)
+		}
+	}
+}
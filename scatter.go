@@ -0,0 +1,151 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const DEFAULT_SCATTER_PARALLEL = 4
+
+// ScatterFailure SqlScatter中一个表的失败
+type ScatterFailure struct {
+	Table    string
+	Instance string
+	Err      error
+}
+
+// ScatterError SqlScatter有表失败时返回，成功的表的结果已经merge
+type ScatterError struct {
+	Cluster string
+	Total   int
+	Failed  []ScatterFailure
+}
+
+func (m *ScatterError) Error() string {
+	fails := make([]string, 0, len(m.Failed))
+	for _, f := range m.Failed {
+		fails = append(fails, fmt.Sprintf("%s@%s:%s", f.Table, f.Instance, f.Err))
+	}
+
+	return fmt.Sprintf("dbrouter scatter cluster:%s failed %d/%d: %s", m.Cluster, len(m.Failed), m.Total, strings.Join(fails, "; "))
+}
+
+type scatterResult[T any] struct {
+	val T
+	err error
+}
+
+// SqlScatter 和包级别的SqlScatter相同，结果类型为interface{}
+func (m *Router) SqlScatter(ctx context.Context, cluster string, tables []string, query func(*DB, string) (interface{}, error), merge func(string, interface{})) error {
+	return SqlScatter(ctx, m, cluster, tables, query, merge)
+}
+
+// SqlScatter 通过m对tables中的每个表执行query，不同instance并行，
+// 每个instance上同时执行的查询数不超过Options.ScatterParallel
+// 所有查询结束后按tables的顺序对成功的结果调用merge，merge不会并发调用
+// 有表没有路由到或者执行失败时返回*ScatterError，其他表的结果照常merge
+// 方法不能有类型参数，所以是包级别的函数；query需要随ctx取消时使用DB的ContextWrapper方法
+func SqlScatter[T any](ctx context.Context, m *Router, cluster string, tables []string, query func(*DB, string) (T, error), merge func(string, T)) error {
+	if len(tables) <= 0 {
+		return fmt.Errorf("tables is empty")
+	}
+
+	if err := checkTables(cluster, tables); err != nil {
+		return err
+	}
+
+	parallel := m.opts.ScatterParallel
+	if parallel <= 0 {
+		parallel = DEFAULT_SCATTER_PARALLEL
+	}
+
+	// 按instance分组，记录表在tables中的位置
+	instances := make([]string, len(tables))
+	groups := make(map[string][]int)
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		return ErrRouterClosed
+	}
+	for i, table := range tables {
+		ins := m.dbCls.getInstance(cluster, table)
+		instances[i] = ins
+		if ins != "" {
+			groups[ins] = append(groups[ins], i)
+		}
+	}
+	m.mu.RUnlock()
+
+	results := make([]scatterResult[T], len(tables))
+	var wg sync.WaitGroup
+	for _, idxs := range groups {
+		work := make(chan int, len(idxs))
+		for _, i := range idxs {
+			work <- i
+		}
+		close(work)
+
+		n := parallel
+		if n > len(idxs) {
+			n = len(idxs)
+		}
+
+		for w := 0; w < n; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range work {
+					table := tables[i]
+					res := &results[i]
+					res.err = m.sqlExec(ctx, sqlWrite, cluster, func(cls *dbCluster) (string, error) {
+						return cls.getSameInstance(cluster, []string{table})
+					}, func(db *DB, _ []interface{}) error {
+						var err error
+						res.val, err = query(db, table)
+						return err
+					}, []string{table})
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	serr := &ScatterError{
+		Cluster: cluster,
+		Total:   len(tables),
+	}
+	for i, table := range tables {
+		if instances[i] == "" {
+			serr.Failed = append(serr.Failed, ScatterFailure{
+				Table: table,
+				Err:   fmt.Errorf("cluster instance not find: cluster:%s table:%s", cluster, table),
+			})
+			continue
+		}
+
+		if results[i].err != nil {
+			serr.Failed = append(serr.Failed, ScatterFailure{
+				Table:    table,
+				Instance: instances[i],
+				Err:      results[i].err,
+			})
+			continue
+		}
+
+		if merge != nil {
+			merge(table, results[i].val)
+		}
+	}
+
+	if len(serr.Failed) > 0 {
+		return serr
+	}
+
+	return nil
+}
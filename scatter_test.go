@@ -0,0 +1,120 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestSqlScatter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+	r.opts.ScatterParallel = 2
+
+	// user0..user18建表，每个表i行，user19不建表
+	var tables []string
+	for i := 0; i < 20; i++ {
+		table := fmt.Sprintf("user%d", i)
+		tables = append(tables, table)
+		if i == 19 {
+			continue
+		}
+
+		err := r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+			if _, err := db.ExecWrapper(tables, "CREATE TABLE {{t0}} (id INTEGER PRIMARY KEY)"); err != nil {
+				return err
+			}
+			for j := 0; j < i; j++ {
+				if _, err := db.ExecWrapper(tables, "INSERT INTO {{t0}} (id) VALUES (?)", j); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, table)
+		if err != nil {
+			t.Fatalf("create table:%s err:%s", table, err)
+		}
+	}
+	tables = append(tables, "user30")
+
+	var mu sync.Mutex
+	running := make(map[*sqlx.DB]int)
+	maxRunning := 0
+
+	var order []string
+	sum := 0
+	err = SqlScatter(context.Background(), r, "ACCOUNT", tables, func(db *DB, table string) (int, error) {
+		// 同一个instance的DB共用一个连接池
+		mu.Lock()
+		running[db.DB]++
+		if running[db.DB] > maxRunning {
+			maxRunning = running[db.DB]
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		defer func() {
+			mu.Lock()
+			running[db.DB]--
+			mu.Unlock()
+		}()
+
+		var c int
+		err := db.GetWrapper([]interface{}{table}, &c, "SELECT count(*) FROM {{t0}}")
+		return c, err
+
+	}, func(table string, v int) {
+		order = append(order, table)
+		sum += v
+	})
+
+	serr, ok := err.(*ScatterError)
+	if !ok {
+		t.Fatalf("scatter err:%v", err)
+	}
+
+	if serr.Total != 21 || len(serr.Failed) != 2 || serr.Failed[0].Table != "user19" || serr.Failed[0].Instance != "file" || serr.Failed[1].Table != "user30" {
+		t.Errorf("scatter failed:%s", serr)
+	}
+
+	if sum != 18*19/2 {
+		t.Errorf("scatter sum:%d", sum)
+	}
+
+	if len(order) != 19 || order[0] != "user0" || order[18] != "user18" {
+		t.Errorf("merge order:%v", order)
+	}
+
+	if maxRunning > 2 {
+		t.Errorf("max running per instance:%d", maxRunning)
+	}
+
+	// 方法版本的结果为interface{}
+	var names []interface{}
+	err = r.SqlScatter(context.Background(), "ACCOUNT", []string{"user1", "user11"}, func(db *DB, table string) (interface{}, error) {
+		return table, nil
+	}, func(table string, v interface{}) {
+		names = append(names, v)
+	})
+	if err != nil || len(names) != 2 || names[0] != "user1" || names[1] != "user11" {
+		t.Errorf("method scatter names:%v err:%v", names, err)
+	}
+}
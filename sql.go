@@ -5,59 +5,288 @@
 package dbrouter
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/bitly/go-simplejson"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/shawnfeng/sutil/slog"
 	"github.com/shawnfeng/sutil/stime"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
+var sqlTypes = []string{DB_TYPE_MYSQL, DB_TYPE_POSTGRES, DB_TYPE_SQLITE}
+
+func isSqlType(dbtype string) bool {
+	for _, tp := range sqlTypes {
+		if tp == dbtype {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	for _, tp := range sqlTypes {
+		tp := tp
+		registerDriver(tp, func(dbname string, cfg json.RawMessage) (Instance, error) {
+			db, err := NewdbSql(tp, dbname, cfg)
+			if err != nil {
+				return nil, err
+			}
+			return db, nil
+
+		}, func(dbname string, cfg json.RawMessage) error {
+			_, err := parsedbSql(tp, dbname, cfg)
+			return err
+		})
+	}
+}
+
+// DB SqlExec传给查询函数的连接
+// Wrapper方法不带context，需要超时或者取消时使用对应的ContextWrapper方法
 type DB struct {
 	*sqlx.DB
 }
 
+// 把tables替换到query中，表名都需要满足checkVarname
+// query中有{{t0}}、{{t1}}这样的占位符时，按序号替换为加了引号的表名，
+// 不再经过fmt.Sprintf，LIKE中的%不需要转义
+// 没有占位符时兼容原来的%s写法，表名原样替换，{{tag}}这种不是t加数字的不算占位符
+func (db *DB) tableQuery(tables []interface{}, query string) (string, error) {
+	return tableQuery(db.DriverName(), tables, query)
+}
+
+func tableQuery(driver string, tables []interface{}, query string) (string, error) {
+	names := make([]string, 0, len(tables))
+	for i, t := range tables {
+		name, ok := t.(string)
+		if !ok {
+			return "", fmt.Errorf("tables[%d]:%v is not string", i, t)
+		}
+
+		if err := checkVarname(name); err != nil {
+			return "", fmt.Errorf("tables[%d]:%s invalid: %s", i, name, err)
+		}
+		names = append(names, name)
+	}
+
+	if !tablePlaceholder.MatchString(query) {
+		return fmt.Sprintf(query, tables...), nil
+	}
+
+	return expandTables(driver, names, query)
+}
+
+var tablePlaceholder = regexp.MustCompile(`\{\{t[0-9]+\}\}`)
+
+// 替换{{tN}}，其他的{{保持原样
+func expandTables(driver string, tables []string, query string) (string, error) {
+	var buf bytes.Buffer
+	for {
+		i := strings.Index(query, "{{t")
+		if i < 0 {
+			buf.WriteString(query)
+			break
+		}
+
+		buf.WriteString(query[:i])
+		rest := query[i+3:]
+
+		n := 0
+		for n < len(rest) && rest[n] >= '0' && rest[n] <= '9' {
+			n++
+		}
+
+		if n == 0 || !strings.HasPrefix(rest[n:], "}}") {
+			buf.WriteString(query[i : i+3])
+			query = rest
+			continue
+		}
+
+		idx, _ := strconv.Atoi(rest[:n])
+		if idx >= len(tables) {
+			return "", fmt.Errorf("query placeholder {{t%d}} out of tables len:%d", idx, len(tables))
+		}
+
+		buf.WriteString(quoteTable(driver, tables[idx]))
+		query = rest[n+2:]
+	}
+
+	return buf.String(), nil
+}
+
+type rowQueryer interface {
+	QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row
+}
+
+// QueryRowx的表名替换，表名出错时返回的Row在Scan时返回这个错误，查询不会发给数据库
+func queryRowx(ctx context.Context, q rowQueryer, driver string, tables []interface{}, query string, args ...interface{}) *sqlx.Row {
+	expanded, err := tableQuery(driver, tables, query)
+	if err != nil {
+		return q.QueryRowxContext(errContext{ctx, err}, "", args...)
+	}
+
+	return q.QueryRowxContext(ctx, expanded, args...)
+}
+
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// sqlx.Row的错误不能从外部设置，database/sql在取连接之前检查ctx，
+// ctx已经结束时直接返回ctx.Err()，Row.Scan得到的就是err
+type errContext struct {
+	context.Context
+	err error
+}
+
+func (m errContext) Done() <-chan struct{} {
+	return closedChan
+}
+
+func (m errContext) Err() error {
+	return m.err
+}
+
+// 表名已经过checkVarname检查，不会包含引号
+// 注意postgres加引号后表名区分大小写
+func quoteTable(driver, table string) string {
+	if driver == DB_TYPE_MYSQL {
+		return "`" + table + "`"
+	}
+
+	return `"` + table + `"`
+}
+
 func (db *DB) NamedExecWrapper(tables []interface{}, query string, arg interface{}) (sql.Result, error) {
-	query = fmt.Sprintf(query, tables...)
-	return db.DB.NamedExec(query, arg)
+	return db.NamedExecContextWrapper(context.Background(), tables, query, arg)
 }
 
 func (db *DB) NamedQueryWrapper(tables []interface{}, query string, arg interface{}) (*sqlx.Rows, error) {
-	query = fmt.Sprintf(query, tables...)
-	return db.DB.NamedQuery(query, arg)
+	return db.NamedQueryContextWrapper(context.Background(), tables, query, arg)
 }
 
 func (db *DB) SelectWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
-	query = fmt.Sprintf(query, tables...)
-	return db.DB.Select(dest, query, args...)
+	return db.SelectContextWrapper(context.Background(), tables, dest, query, args...)
 }
 
 func (db *DB) ExecWrapper(tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
-	query = fmt.Sprintf(query, tables...)
-	return db.DB.Exec(query, args...)
+	return db.ExecContextWrapper(context.Background(), tables, query, args...)
 }
 
 func (db *DB) QueryRowxWrapper(tables []interface{}, query string, args ...interface{}) *sqlx.Row {
-	query = fmt.Sprintf(query, tables...)
-	return db.DB.QueryRowx(query, args...)
+	return db.QueryRowxContextWrapper(context.Background(), tables, query, args...)
 }
 
 func (db *DB) QueryxWrapper(tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
-	query = fmt.Sprintf(query, tables...)
-	return db.DB.Queryx(query, args...)
+	return db.QueryxContextWrapper(context.Background(), tables, query, args...)
 }
 
 func (db *DB) GetWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
-	query = fmt.Sprintf(query, tables...)
-	return db.DB.Get(dest, query, args...)
+	return db.GetContextWrapper(context.Background(), tables, dest, query, args...)
+}
+
+func (db *DB) PreparexWrapper(tables []interface{}, query string) (*sqlx.Stmt, error) {
+	return db.PreparexContextWrapper(context.Background(), tables, query)
+}
+
+func (db *DB) PrepareNamedWrapper(tables []interface{}, query string) (*sqlx.NamedStmt, error) {
+	return db.PrepareNamedContextWrapper(context.Background(), tables, query)
+}
+
+func (db *DB) NamedExecContextWrapper(ctx context.Context, tables []interface{}, query string, arg interface{}) (sql.Result, error) {
+	q, err := db.tableQuery(tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.DB.NamedExecContext(ctx, q, arg)
+}
+
+func (db *DB) NamedQueryContextWrapper(ctx context.Context, tables []interface{}, query string, arg interface{}) (*sqlx.Rows, error) {
+	q, err := db.tableQuery(tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.DB.NamedQueryContext(ctx, q, arg)
+}
+
+func (db *DB) SelectContextWrapper(ctx context.Context, tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	q, err := db.tableQuery(tables, query)
+	if err != nil {
+		return err
+	}
+
+	return db.DB.SelectContext(ctx, dest, q, args...)
+}
+
+func (db *DB) ExecContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
+	q, err := db.tableQuery(tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.DB.ExecContext(ctx, q, args...)
+}
+
+func (db *DB) QueryRowxContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) *sqlx.Row {
+	return queryRowx(ctx, db.DB, db.DriverName(), tables, query, args...)
+}
+
+func (db *DB) QueryxContextWrapper(ctx context.Context, tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
+	q, err := db.tableQuery(tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.DB.QueryxContext(ctx, q, args...)
+}
+
+func (db *DB) GetContextWrapper(ctx context.Context, tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	q, err := db.tableQuery(tables, query)
+	if err != nil {
+		return err
+	}
+
+	return db.DB.GetContext(ctx, dest, q, args...)
+}
+
+// PreparexContextWrapper 预处理语句绑定在替换后的表名上，ctx只用于prepare
+// 执行时使用Stmt的Context方法
+func (db *DB) PreparexContextWrapper(ctx context.Context, tables []interface{}, query string) (*sqlx.Stmt, error) {
+	q, err := db.tableQuery(tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.DB.PreparexContext(ctx, q)
+}
+
+func (db *DB) PrepareNamedContextWrapper(ctx context.Context, tables []interface{}, query string) (*sqlx.NamedStmt, error) {
+	q, err := db.tableQuery(tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.DB.PrepareNamedContext(ctx, q)
 }
 
 func NewDB(sqlxdb *sqlx.DB) *DB {
 	db := &DB{
-		sqlxdb,
+		DB: sqlxdb,
 	}
 	return db
 }
@@ -70,27 +299,157 @@ type dbSql struct {
 	userName string
 	passWord string
 	db       *DB
+
+	// 从库，addrs中r:开头的地址，读查询由balancer选择
+	replicaAddrs []string
+	replicas     []*sqlReplica
+	balancer     Balancer
+
+	// 主库和从库使用相同的连接池配置
+	pool sqlPool
+
+	// 拼到DSN中的参数和tls配置
+	params map[string]string
+	tls    *sqlTLS
+	// mysql驱动中注册的tls配置名，Close时释放
+	tlsName string
+
+	// max_lag大于0时探测从库延迟，lagging为当前延迟超标的从库数
+	maxLag      time.Duration
+	lagInterval time.Duration
+	lagging     int32
+	prober      *lagProber
+}
+
+// 连接池配置，时间单位为毫秒
+type sqlPool struct {
+	// 0表示不限制
+	MaxOpen int `json:"max_open"`
+	// 0表示不保留空闲连接，每次查询都新建连接，用完关闭
+	MaxIdle int `json:"max_idle"`
+	// 0表示不限制
+	ConnMaxLifetime int64 `json:"conn_max_lifetime"`
+	ConnMaxIdleTime int64 `json:"conn_max_idle_time"`
+}
+
+// 没有配置时的连接池大小
+const (
+	DEFAULT_MAX_OPEN = 128
+	DEFAULT_MAX_IDLE = 8
+)
+
+type poolSetter interface {
+	SetMaxOpenConns(n int)
+	SetMaxIdleConns(n int)
+	SetConnMaxLifetime(d time.Duration)
+	SetConnMaxIdleTime(d time.Duration)
 }
 
-func (m *dbSql) getType() string {
+func (m *sqlPool) apply(db poolSetter) {
+	db.SetMaxOpenConns(m.MaxOpen)
+	db.SetMaxIdleConns(m.MaxIdle)
+	db.SetConnMaxLifetime(time.Duration(m.ConnMaxLifetime) * time.Millisecond)
+	db.SetConnMaxIdleTime(time.Duration(m.ConnMaxIdleTime) * time.Millisecond)
+}
+
+type sqlMode int
+
+const (
+	sqlWrite sqlMode = 0
+	sqlRead  sqlMode = 1
+)
+
+func (m *dbSql) Type() string {
 	return m.dbType
 }
 
 func NewdbSql(dbtype, dbname string, cfg []byte) (*dbSql, error) {
 	fun := "NewdbSql-->"
 
+	info, err := parsedbSql(dbtype, dbname, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// 主库和从库共用一个tls配置
+	if info.dbType == DB_TYPE_MYSQL && info.tls != nil {
+		if info.tlsName, err = registerMysqlTLS(info.tls); err != nil {
+			return nil, err
+		}
+	}
+
+	info.db, err = dial(info, info.dbAddrs)
+	if err != nil {
+		slog.Errorf("%s dbtype:%s dbname:%s cfg:%s", fun, info.dbType, info.dbName, string(cfg))
+		info.Close()
+		return nil, err
+	}
+	info.pool.apply(info.db)
+
+	for _, addr := range info.replicaAddrs {
+		db, err := dial(info, addr)
+		if err != nil {
+			slog.Errorf("%s dbtype:%s dbname:%s replica:%s cfg:%s", fun, info.dbType, info.dbName, addr, string(cfg))
+			info.Close()
+			return nil, err
+		}
+		info.pool.apply(db)
+		info.replicas = append(info.replicas, &sqlReplica{addr: addr, db: db})
+	}
+
+	if info.maxLag > 0 && len(info.replicas) > 0 {
+		if measure := lagMeasureFor(info.dbType); measure != nil {
+			info.prober = newLagProber(info, measure)
+			info.prober.start()
+		}
+	}
+
+	return info, err
+}
+
+// 只解析配置，不建立连接
+func parsedbSql(dbtype, dbname string, cfg []byte) (*dbSql, error) {
 	cfg_json, err := simplejson.NewJson(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("instance db:%s type:%s config:%s unmarshal err:%s", dbname, dbtype, cfg, err)
 	}
 
-	addrs, err := cfg_json.Get("addrs").StringArray()
+	var addr string
+	var replicas []string
+	if dbtype == DB_TYPE_SQLITE {
+		// sqlite没有地址，path为数据库文件，:memory:为内存数据库
+		addr, err = cfg_json.Get("path").String()
+		if err != nil || addr == "" {
+			return nil, fmt.Errorf("instance db:%s type:%s config:%s path err:%v", dbname, dbtype, cfg, err)
+		}
+
+	} else {
+		addrs, err := cfg_json.Get("addrs").StringArray()
+		if err != nil {
+			return nil, fmt.Errorf("instance db:%s type:%s config:%s addrs err:%s", dbname, dbtype, cfg, err)
+		}
+
+		addr, replicas, err = splitAddrs(addrs)
+		if err != nil {
+			return nil, fmt.Errorf("instance db:%s type:%s config:%s addrs err:%s", dbname, dbtype, cfg, err)
+		}
+	}
+
+	params, tlscfg, err := parseDSNOptions(dbtype, cfg_json)
 	if err != nil {
-		return nil, fmt.Errorf("instance db:%s type:%s config:%s addrs err:%s", dbname, dbtype, cfg, err)
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s err:%s", dbname, dbtype, cfg, err)
+	}
+
+	balancerName := BALANCER_ROUND_ROBIN
+	if v, ok := cfg_json.CheckGet("balancer"); ok {
+		if balancerName, err = v.String(); err != nil {
+			return nil, fmt.Errorf("instance db:%s type:%s config:%s balancer must be string", dbname, dbtype, cfg)
+		}
 	}
 
-	if len(addrs) != 1 {
-		return nil, fmt.Errorf("instance db:%s type:%s config:%s len(addrs)!=1", dbname, dbtype, cfg)
+	balancer, err := newBalancer(balancerName)
+	if err != nil {
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s err:%s", dbname, dbtype, cfg, err)
 	}
 
 	timeout := 60 * time.Second
@@ -98,42 +457,136 @@ func NewdbSql(dbtype, dbname string, cfg []byte) (*dbSql, error) {
 		timeout = time.Duration(t) * time.Millisecond
 	}
 
+	// 从库延迟阈值和探测间隔，单位毫秒
+	var lags [2]time.Duration
+	for i, key := range []string{"max_lag", "lag_interval"} {
+		if v, ok := cfg_json.CheckGet(key); ok {
+			t, err := v.Int64()
+			if err != nil || t < 0 {
+				return nil, fmt.Errorf("instance db:%s type:%s config:%s %s must be int >= 0", dbname, dbtype, cfg, key)
+			}
+			lags[i] = time.Duration(t) * time.Millisecond
+		}
+	}
+
+	pool := sqlPool{
+		MaxOpen: DEFAULT_MAX_OPEN,
+		MaxIdle: DEFAULT_MAX_IDLE,
+	}
+
+	ints := []struct {
+		key string
+		val *int
+	}{
+		{"max_open", &pool.MaxOpen},
+		{"max_idle", &pool.MaxIdle},
+	}
+
+	for _, i := range ints {
+		if v, ok := cfg_json.CheckGet(i.key); ok {
+			n, err := v.Int()
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("instance db:%s type:%s config:%s %s must be int >= 0", dbname, dbtype, cfg, i.key)
+			}
+			*i.val = n
+		}
+	}
+
+	durs := []struct {
+		key string
+		val *int64
+	}{
+		{"conn_max_lifetime", &pool.ConnMaxLifetime},
+		{"conn_max_idle_time", &pool.ConnMaxIdleTime},
+	}
+
+	for _, d := range durs {
+		if v, ok := cfg_json.CheckGet(d.key); ok {
+			t, err := v.Int64()
+			if err != nil || t < 0 {
+				return nil, fmt.Errorf("instance db:%s type:%s config:%s %s must be int >= 0", dbname, dbtype, cfg, d.key)
+			}
+			*d.val = t
+		}
+	}
+
+	// max_open为0时不限制连接数，只配置了较小的max_open时max_idle跟着调小
+	if pool.MaxOpen > 0 && pool.MaxIdle > pool.MaxOpen {
+		if _, ok := cfg_json.CheckGet("max_idle"); !ok {
+			pool.MaxIdle = pool.MaxOpen
+		}
+	}
+
+	if pool.MaxOpen > 0 && pool.MaxIdle > pool.MaxOpen {
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s max_idle:%d > max_open:%d", dbname, dbtype, cfg, pool.MaxIdle, pool.MaxOpen)
+	}
+
+	// 内存库在最后一个连接关闭时销毁，不保留空闲连接时每次查询之后数据都会丢失
+	if dbtype == DB_TYPE_SQLITE && addr == SQLITE_MEMORY && pool.MaxIdle == 0 {
+		return nil, fmt.Errorf("instance db:%s type:%s config:%s max_idle:0 not allowed for %s", dbname, dbtype, cfg, SQLITE_MEMORY)
+	}
+
 	user, _ := cfg_json.Get("user").String()
 	passwd, _ := cfg_json.Get("passwd").String()
 
-	info := &dbSql{
-		dbType:   dbtype,
-		dbName:   dbname,
-		dbAddrs:  addrs[0],
-		timeOut:  timeout,
-		userName: user,
-		passWord: passwd,
+	return &dbSql{
+		dbType:       dbtype,
+		dbName:       dbname,
+		dbAddrs:      addr,
+		timeOut:      timeout,
+		userName:     user,
+		passWord:     passwd,
+		replicaAddrs: replicas,
+		balancer:     balancer,
+		pool:         pool,
+		params:       params,
+		tls:          tlscfg,
+		maxLag:       lags[0],
+		lagInterval:  lags[1],
+	}, nil
+}
+
+// addrs只有一个地址时为主库，多个地址时w:开头的为主库，r:开头的为从库
+// 主库只能有一个
+func splitAddrs(addrs []string) (string, []string, error) {
+	if len(addrs) == 1 && !strings.HasPrefix(addrs[0], "r:") {
+		return strings.TrimPrefix(addrs[0], "w:"), nil, nil
 	}
 
-	info.db, err = dial(info)
-	if err != nil {
-		slog.Errorf("%s dbtype:%s dbname:%s cfg:%s", fun, info.dbType, info.dbName, string(cfg))
-		return nil, err
+	var primary string
+	var replicas []string
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "w:") {
+			if primary != "" {
+				return "", nil, fmt.Errorf("more than one w: addr")
+			}
+			primary = addr[2:]
+
+		} else if strings.HasPrefix(addr, "r:") {
+			replicas = append(replicas, addr[2:])
+
+		} else {
+			return "", nil, fmt.Errorf("addr:%s need w: or r: prefix", addr)
+		}
 	}
-	info.db.SetMaxIdleConns(8)
-	info.db.SetMaxOpenConns(128)
-	return info, err
+
+	if primary == "" {
+		return "", nil, fmt.Errorf("no w: addr")
+	}
+
+	return primary, replicas, nil
 }
 
-func dial(info *dbSql) (db *DB, err error) {
+func dial(info *dbSql, addr string) (db *DB, err error) {
 	fun := "dial-->"
 
-	var dataSourceName string
-	if info.dbType == DB_TYPE_MYSQL {
-		dataSourceName = fmt.Sprintf("%s:%s@tcp(%s)/%s", info.userName, info.passWord, info.dbAddrs, info.dbName)
-
-	} else if info.dbType == DB_TYPE_POSTGRES {
-		dataSourceName = fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=disable",
-			info.userName, info.passWord, info.dbAddrs, info.dbName)
+	dsn, err := dataSourceName(info, addr)
+	if err != nil {
+		return NewDB(nil), err
 	}
 
-	slog.Infof("%s dbtype:%s datasourcename:%s", fun, info.dbType, dataSourceName)
-	sqlxdb, err := sqlx.Connect(info.dbType, dataSourceName)
+	slog.Infof("%s dbtype:%s datasourcename:%s", fun, info.dbType, redactedDSN(info, addr))
+	sqlxdb, err := sqlx.Connect(info.dbType, dsn)
 	return NewDB(sqlxdb), err
 }
 
@@ -141,39 +594,228 @@ func (m *dbSql) getDB() *DB {
 	return m.db
 }
 
+// 读查询由balancer在延迟正常的从库中选择，没有可用的从库时使用主库
+func (m *dbSql) getModeDB(mode sqlMode) *DB {
+	if mode != sqlRead || len(m.replicas) == 0 {
+		return m.db
+	}
+
+	addrs, replicas := m.replicaAddrs, m.replicas
+	if atomic.LoadInt32(&m.lagging) > 0 {
+		addrs, replicas = nil, nil
+		for _, r := range m.replicas {
+			if r.healthy() {
+				addrs = append(addrs, r.addr)
+				replicas = append(replicas, r)
+			}
+		}
+
+		if len(replicas) == 0 {
+			return m.db
+		}
+	}
+
+	i := m.balancer.Pick(addrs)
+	if i < 0 || i >= len(replicas) {
+		return m.db
+	}
+
+	return replicas[i].db
+}
+
+func (m *dbSql) Ping(ctx context.Context) error {
+	if err := m.db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	for _, r := range m.replicas {
+		if err := r.db.PingContext(ctx); err != nil {
+			return fmt.Errorf("replica:%s err:%s", r.addr, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *dbSql) Close() error {
+	if m.prober != nil {
+		m.prober.close()
+	}
+
+	var err error
+	if m.db != nil && m.db.DB != nil {
+		err = m.db.Close()
+	}
+
+	for _, r := range m.replicas {
+		if er := r.db.Close(); er != nil && err == nil {
+			err = er
+		}
+	}
+
+	if m.tlsName != "" {
+		releaseMysqlTLS(m.tlsName)
+		m.tlsName = ""
+	}
+
+	return err
+}
+
 func (m *Router) SqlExec(cluster string, query func(*DB, []interface{}) error, tables ...string) error {
-	stall := stime.NewTimeStat()
-	st := stime.NewTimeStat()
+	return m.SqlExecContext(context.Background(), cluster, query, tables...)
+}
+
+// SqlExecContext 和SqlExec相同，ctx已经结束时不会占用实例，直接返回ctx.Err()
+// 查询需要随ctx取消时，在query中把ctx传给DB的ContextWrapper方法
+// tables必须都路由到同一个instance，否则返回错误，不会执行query
+func (m *Router) SqlExecContext(ctx context.Context, cluster string, query func(*DB, []interface{}) error, tables ...string) error {
+	if len(tables) <= 0 {
+		return fmt.Errorf("tables is empty")
+	}
+
+	return m.sqlExec(ctx, sqlWrite, cluster, func(cls *dbCluster) (string, error) {
+		return cls.getSameInstance(cluster, tables)
+	}, query, tables)
+}
+
+// SqlExecRead 读查询，在tables路由到的instance的从库上执行，没有从库时使用主库
+// 从库由dbcfg中balancer指定的Balancer选择
+func (m *Router) SqlExecRead(ctx context.Context, cluster string, query func(*DB, []interface{}) error, tables ...string) error {
+	if len(tables) <= 0 {
+		return fmt.Errorf("tables is empty")
+	}
+
+	return m.sqlExec(ctx, sqlRead, cluster, func(cls *dbCluster) (string, error) {
+		return cls.getSameInstance(cluster, tables)
+	}, query, tables)
+}
+
+// SqlExecWrite 在主库上执行，和SqlExecContext相同
+func (m *Router) SqlExecWrite(ctx context.Context, cluster string, query func(*DB, []interface{}) error, tables ...string) error {
+	return m.SqlExecContext(ctx, cluster, query, tables...)
+}
+
+// SqlExecSplit tables按路由到的instance分组，每组调用一次query，
+// query收到的是该instance的DB和这一组表，组按tables中第一次出现的顺序执行
+// 有一组出错时不再执行后面的组，ErrRouterClosed和ctx的错误原样返回，
+// 其他错误加上instance和表名，可以用errors.Is和errors.As判断原来的错误
+func (m *Router) SqlExecSplit(ctx context.Context, cluster string, query func(*DB, []interface{}) error, tables ...string) error {
 	if len(tables) <= 0 {
 		return fmt.Errorf("tables is empty")
 	}
 
+	if err := checkTables(cluster, tables); err != nil {
+		return err
+	}
+
+	groups, err := m.groupByInstance(cluster, tables)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		// 分组之后可能发生Reload，执行时再检查一次
+		err := m.sqlExec(ctx, sqlWrite, cluster, func(cls *dbCluster) (string, error) {
+			return cls.getSameInstance(cluster, g.tables)
+		}, query, g.tables)
+		if err == ErrRouterClosed || (err != nil && err == ctx.Err()) {
+			return err
+		}
+
+		if err != nil {
+			return fmt.Errorf("instance:%s tables:%s err:%w", g.instance, strings.Join(g.tables, ","), err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Router) groupByInstance(cluster string, tables []string) ([]*insTables, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return nil, ErrRouterClosed
+	}
+
+	return m.dbCls.groupByInstance(cluster, tables)
+}
+
+// SqlExecByKey 按调用方给的分片key路由，tables[0]为hash规则配置的表前缀
+func (m *Router) SqlExecByKey(cluster, key string, query func(*DB, []interface{}) error, tables ...string) error {
+	return m.SqlExecByKeyContext(context.Background(), cluster, key, query, tables...)
+}
+
+// SqlExecByKeyContext 和SqlExecByKey相同，ctx的用法同SqlExecContext
+func (m *Router) SqlExecByKeyContext(ctx context.Context, cluster, key string, query func(*DB, []interface{}) error, tables ...string) error {
+	if len(tables) <= 0 {
+		return fmt.Errorf("tables is empty")
+	}
+
+	return m.sqlExec(ctx, sqlWrite, cluster, func(cls *dbCluster) (string, error) {
+		return cls.getSameInstanceByKey(cluster, key, tables)
+	}, query, tables)
+}
+
+// 传给查询函数的表名最终会拼到sql中，路由之前先检查
+func checkTables(cluster string, tables []string) error {
+	for _, table := range tables {
+		if err := checkVarname(table); err != nil {
+			return fmt.Errorf("cluster:%s table:%s invalid: %s", cluster, table, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Router) sqlExec(ctx context.Context, mode sqlMode, cluster string, getInstance func(*dbCluster) (string, error), query func(*DB, []interface{}) error, tables []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := checkTables(cluster, tables); err != nil {
+		return err
+	}
+
+	stall := stime.NewTimeStat()
+	st := stime.NewTimeStat()
+
 	table := tables[0]
-	ins_name := m.dbCls.getInstance(cluster, table)
-	if ins_name == "" {
-		return fmt.Errorf("cluster instance not find: cluster:%s table:%s", cluster, table)
+	var rerr error
+	_, entry, err := m.acquireInstance(func(cls *dbCluster) string {
+		var ins string
+		ins, rerr = getInstance(cls)
+		return ins
+	})
+	if err != nil {
+		return err
+	}
+
+	if rerr != nil {
+		return rerr
 	}
 
 	durInsn := st.Duration()
 	st.Reset()
 
-	ins := m.dbIns.get(ins_name)
-	if ins == nil {
+	if entry == nil {
 		return fmt.Errorf("db instance not find: cluster:%s table:%s", cluster, table)
 	}
+	defer entry.release()
+	ins := entry.ins
 
 	durIns := st.Duration()
 	st.Reset()
 
 	dbsql, ok := ins.(*dbSql)
 	if !ok {
-		return fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, ins.getType())
+		return fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, ins.Type())
 	}
 
 	durInst := st.Duration()
 	st.Reset()
 
-	db := dbsql.getDB()
+	db := dbsql.getModeDB(mode)
 
 	defer func() {
 		dur := st.Duration()
@@ -193,7 +835,13 @@ func (m *Router) SqlExecDeprecated(cluster, table string, query func(*sqlx.DB) e
 	stall := stime.NewTimeStat()
 	st := stime.NewTimeStat()
 
-	ins_name := m.dbCls.getInstance(cluster, table)
+	ins_name, entry, err := m.acquireInstance(func(cls *dbCluster) string {
+		return cls.getInstance(cluster, table)
+	})
+	if err != nil {
+		return err
+	}
+
 	if ins_name == "" {
 		return fmt.Errorf("cluster instance not find: cluster:%s table:%s", cluster, table)
 	}
@@ -201,17 +849,18 @@ func (m *Router) SqlExecDeprecated(cluster, table string, query func(*sqlx.DB) e
 	durInsn := st.Duration()
 	st.Reset()
 
-	ins := m.dbIns.get(ins_name)
-	if ins == nil {
+	if entry == nil {
 		return fmt.Errorf("db instance not find: cluster:%s table:%s", cluster, table)
 	}
+	defer entry.release()
+	ins := entry.ins
 
 	durIns := st.Duration()
 	st.Reset()
 
 	dbsql, ok := ins.(*dbSql)
 	if !ok {
-		return fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, ins.getType())
+		return fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, ins.Type())
 	}
 
 	durInst := st.Duration()
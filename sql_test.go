@@ -0,0 +1,647 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 内存库按dbname在进程内共享，每个Router用不同的dbname
+var sqliteSeq int32
+
+func newSqliteRouter(t *testing.T, path string) *Router {
+	dbname := fmt.Sprintf("taccount%d", atomic.AddInt32(&sqliteSeq, 1))
+	cfg := []byte(`{
+		"cluster": {
+			"ACCOUNT": [
+				{"instance": "mem", "match": "range", "express": "user[0-9]"},
+				{"instance": "file", "match": "range", "express": "user[10-19]"}
+			]
+		},
+		"instances": {
+			"mem": {"dbtype": "sqlite3", "dbname": "` + dbname + `", "dbcfg": {"path": ":memory:"}},
+			"file": {"dbtype": "sqlite3", "dbname": "` + dbname + `", "dbcfg": {"path": "` + path + `"}}
+		}
+	}`)
+
+	r, err := NewRouterWithOptions(cfg, Options{Strict: true})
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+
+	return r
+}
+
+func TestSqlite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+
+	type user struct {
+		Id   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+
+	for _, table := range []string{"user1", "user11"} {
+		err := r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+			if _, err := db.ExecWrapper(tables, "CREATE TABLE %s (id INTEGER PRIMARY KEY, name TEXT)"); err != nil {
+				return err
+			}
+
+			_, err := db.NamedExecWrapper(tables, "INSERT INTO %s (id, name) VALUES (:id, :name)", &user{1, table})
+			return err
+		}, table)
+		if err != nil {
+			t.Fatalf("create table:%s err:%s", table, err)
+		}
+	}
+
+	for _, table := range []string{"user1", "user11"} {
+		var u user
+		err := r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+			return db.GetWrapper(tables, &u, "SELECT id, name FROM %s WHERE id=?", 1)
+		}, table)
+		if err != nil {
+			t.Fatalf("get table:%s err:%s", table, err)
+		}
+
+		if u.Name != table {
+			t.Errorf("table:%s got name:%s", table, u.Name)
+		}
+	}
+
+	// 文件库在磁盘上
+	if _, err := os.Stat(filepath.Join(dir, "account.db")); err != nil {
+		t.Errorf("sqlite file not created:%s", err)
+	}
+
+	// 内存库的表不在文件库里
+	filedb := r.dbIns.get("file").(*dbSql).getDB()
+	var n int
+	if err := filedb.Get(&n, "SELECT count(*) FROM user1"); err == nil {
+		t.Errorf("file db should not have table user1")
+	}
+
+	// dbname不同的内存库互不影响
+	r2 := newSqliteRouter(t, filepath.Join(dir, "account2.db"))
+	defer r2.Close(context.Background())
+
+	err = r2.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		return db.GetWrapper(tables, &n, "SELECT count(*) FROM {{t0}}")
+	}, "user1")
+	if err == nil {
+		t.Errorf("memory db of another dbname should not have table user1")
+	}
+}
+
+func TestSqliteConfig(t *testing.T) {
+	cfg := []byte(`{
+		"cluster": {"ACCOUNT": [{"instance": "mem", "match": "full", "express": "user"}]},
+		"instances": {"mem": {"dbtype": "sqlite3", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:3306"]}}}
+	}`)
+
+	issues, err := ValidateConfig(cfg)
+	if err != nil || len(issues) != 2 || issues[0].Path != "instances.mem.dbcfg" {
+		t.Errorf("sqlite without path issues:%v err:%v", issues, err)
+	}
+}
+
+func TestSqlExecContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+
+	var kept *DB
+	ctx, cancel := context.WithCancel(context.Background())
+	err = r.SqlExecContext(ctx, "ACCOUNT", func(db *DB, tables []interface{}) error {
+		kept = db
+		if _, err := db.ExecContextWrapper(ctx, tables, "CREATE TABLE %s (id INTEGER PRIMARY KEY)"); err != nil {
+			return err
+		}
+
+		// 查询中途取消，后面的查询使用同一个ctx
+		cancel()
+		_, err := db.ExecContextWrapper(ctx, tables, "INSERT INTO %s (id) VALUES (1)")
+		return err
+	}, "user12")
+	if err != context.Canceled {
+		t.Errorf("exec canceled err:%v", err)
+	}
+
+	// DB不保存ctx，回调结束后不带context的Wrapper不受影响
+	var n int
+	if err := kept.GetWrapper([]interface{}{"user12"}, &n, "SELECT count(*) FROM %s"); err != nil || n != 0 {
+		t.Errorf("kept db count err:%v n:%d", err, n)
+	}
+
+	called := false
+	err = r.SqlExecContext(ctx, "ACCOUNT", func(db *DB, tables []interface{}) error {
+		called = true
+		return nil
+	}, "user12")
+	if err != context.Canceled || called {
+		t.Errorf("exec done ctx err:%v called:%v", err, called)
+	}
+
+	err = r.SqlExecByKeyContext(ctx, "ACCOUNT", "1", func(db *DB, tables []interface{}) error {
+		called = true
+		return nil
+	}, "user")
+	if err != context.Canceled || called {
+		t.Errorf("exec by key done ctx err:%v called:%v", err, called)
+	}
+
+	err = r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		return db.GetWrapper(tables, &n, "SELECT count(*) FROM %s")
+	}, "user12")
+	if err != nil || n != 0 {
+		t.Errorf("count err:%v n:%d", err, n)
+	}
+}
+
+func TestContextWrapper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+
+	type user struct {
+		Id   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+
+	ctx := context.Background()
+	err = r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		if _, err := db.ExecContextWrapper(ctx, tables, "CREATE TABLE %s (id INTEGER PRIMARY KEY, name TEXT)"); err != nil {
+			return err
+		}
+
+		nstmt, err := db.PrepareNamedContextWrapper(ctx, tables, "INSERT INTO %s (id, name) VALUES (:id, :name)")
+		if err != nil {
+			return err
+		}
+		defer nstmt.Close()
+
+		for i, name := range []string{"a", "b", "c"} {
+			if _, err := nstmt.ExecContext(ctx, &user{int64(i + 1), name}); err != nil {
+				return err
+			}
+		}
+
+		stmt, err := db.PreparexContextWrapper(ctx, tables, "SELECT id, name FROM %s WHERE id=?")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		var u user
+		if err := stmt.GetContext(ctx, &u, 2); err != nil {
+			return err
+		}
+		if u.Name != "b" {
+			t.Errorf("stmt get name:%s", u.Name)
+		}
+
+		var us []user
+		if err := db.SelectContextWrapper(ctx, tables, &us, "SELECT id, name FROM %s ORDER BY id"); err != nil {
+			return err
+		}
+		if len(us) != 3 {
+			t.Errorf("select len:%d", len(us))
+		}
+
+		// 使用参数中的ctx
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if err := db.GetContextWrapper(canceled, tables, &u, "SELECT id, name FROM %s WHERE id=?", 1); err != context.Canceled {
+			t.Errorf("get canceled err:%v", err)
+		}
+
+		return nil
+	}, "user13")
+	if err != nil {
+		t.Fatalf("exec err:%s", err)
+	}
+}
+
+func TestExpandTables(t *testing.T) {
+	tables := []string{"user1", "order1"}
+
+	cases := []struct {
+		driver string
+		query  string
+		want   string
+	}{
+		{DB_TYPE_MYSQL, "SELECT * FROM {{t0}} JOIN {{t1}} ON {{t0}}.id={{t1}}.uid", "SELECT * FROM `user1` JOIN `order1` ON `user1`.id=`order1`.uid"},
+		{DB_TYPE_POSTGRES, "SELECT * FROM {{t1}} WHERE name LIKE '%a%'", `SELECT * FROM "order1" WHERE name LIKE '%a%'`},
+		{DB_TYPE_SQLITE, "SELECT '{{tx}}', '{{t' FROM {{t0}}", `SELECT '{{tx}}', '{{t' FROM "user1"`},
+	}
+
+	for _, c := range cases {
+		got, err := expandTables(c.driver, tables, c.query)
+		if err != nil || got != c.want {
+			t.Errorf("driver:%s query:%s got:%s err:%v", c.driver, c.query, got, err)
+		}
+	}
+
+	if _, err := expandTables(DB_TYPE_MYSQL, tables, "SELECT * FROM {{t2}}"); err == nil {
+		t.Errorf("placeholder out of range should fail")
+	}
+}
+
+func TestTableQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+
+	err = r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		if _, err := db.ExecWrapper(tables, "CREATE TABLE {{t0}} (id INTEGER PRIMARY KEY, name TEXT)"); err != nil {
+			return err
+		}
+
+		if _, err := db.ExecWrapper(tables, "INSERT INTO {{t0}} (id, name) VALUES (1, 'abc'), (2, 'xyz')"); err != nil {
+			return err
+		}
+
+		var n int
+		if err := db.GetWrapper(tables, &n, "SELECT count(*) FROM {{t0}} WHERE name LIKE '%b%'"); err != nil {
+			return err
+		}
+		if n != 1 {
+			t.Errorf("like count:%d", n)
+		}
+
+		// 没有{{tN}}时按原来的%s替换，{{tag}}不是占位符
+		legacy := "SELECT count(*) FROM %s WHERE name='{{tag}}'"
+		if q, err := db.tableQuery(tables, legacy); err != nil || q != "SELECT count(*) FROM user14 WHERE name='{{tag}}'" {
+			t.Errorf("legacy query:%s err:%v", q, err)
+		}
+
+		if err := db.GetWrapper(tables, &n, legacy); err != nil || n != 0 {
+			t.Errorf("legacy count:%d err:%v", n, err)
+		}
+
+		// 调用方自己拼的表名也要检查
+		bad := []interface{}{"user14; DROP TABLE user14"}
+		if _, err := db.ExecWrapper(bad, "DELETE FROM %s"); err == nil {
+			t.Errorf("bad table should fail")
+		}
+
+		// Scan返回表名的错误，而不是context canceled
+		if err := db.QueryRowxWrapper(bad, "SELECT count(*) FROM {{t0}}").Scan(&n); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("bad table row scan err:%v", err)
+		}
+
+		if err := db.QueryRowxWrapper(tables, "SELECT count(*) FROM {{t1}}").Scan(&n); err == nil || !strings.Contains(err.Error(), "{{t1}}") {
+			t.Errorf("bad placeholder row scan err:%v", err)
+		}
+
+		return db.GetWrapper(tables, &n, "SELECT count(*) FROM {{t0}}")
+	}, "user14")
+	if err != nil {
+		t.Fatalf("exec err:%s", err)
+	}
+
+	err = r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		t.Errorf("query should not be called")
+		return nil
+	}, "user1 --")
+	if err == nil {
+		t.Errorf("invalid table should fail")
+	}
+}
+
+func TestSqlExecCrossInstance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+
+	called := false
+	err = r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		called = true
+		return nil
+	}, "user1", "user11")
+	if err == nil || called || !strings.Contains(err.Error(), "user1->mem") || !strings.Contains(err.Error(), "user11->file") {
+		t.Errorf("cross instance err:%v called:%v", err, called)
+	}
+
+	// 同一个instance上的多个表可以一起用
+	err = r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		return nil
+	}, "user1", "user2")
+	if err != nil {
+		t.Errorf("same instance err:%s", err)
+	}
+
+	got := make(map[string][]interface{})
+	err = r.SqlExecSplit(context.Background(), "ACCOUNT", func(db *DB, tables []interface{}) error {
+		var name string
+		if err := db.Get(&name, "SELECT file FROM pragma_database_list WHERE name='main'"); err != nil {
+			return err
+		}
+
+		if name == "" {
+			name = "mem"
+		} else {
+			name = "file"
+		}
+		got[name] = tables
+		return nil
+	}, "user1", "user11", "user2")
+	if err != nil {
+		t.Fatalf("split err:%s", err)
+	}
+
+	if !reflect.DeepEqual(got, map[string][]interface{}{
+		"mem":  {"user1", "user2"},
+		"file": {"user11"},
+	}) {
+		t.Errorf("split got:%v", got)
+	}
+
+	err = r.SqlExecSplit(context.Background(), "ACCOUNT", func(db *DB, tables []interface{}) error {
+		return nil
+	}, "user1", "user100")
+	if err == nil {
+		t.Errorf("split unrouted table should fail")
+	}
+
+	// query的错误可以用errors.Is判断
+	err = r.SqlExecSplit(context.Background(), "ACCOUNT", func(db *DB, tables []interface{}) error {
+		return sql.ErrNoRows
+	}, "user1", "user11")
+	if !errors.Is(err, sql.ErrNoRows) || !strings.Contains(err.Error(), "instance:mem") {
+		t.Errorf("split query err:%v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = r.SqlExecSplit(ctx, "ACCOUNT", func(db *DB, tables []interface{}) error {
+		return nil
+	}, "user1", "user11")
+	if err != context.Canceled {
+		t.Errorf("split canceled err:%v", err)
+	}
+
+	r.Close(context.Background())
+	err = r.SqlExecSplit(context.Background(), "ACCOUNT", func(db *DB, tables []interface{}) error {
+		return nil
+	}, "user1", "user11")
+	if err != ErrRouterClosed {
+		t.Errorf("split closed err:%v", err)
+	}
+}
+
+func TestSplitAddrs(t *testing.T) {
+	cases := []struct {
+		addrs    []string
+		primary  string
+		replicas []string
+		fail     bool
+	}{
+		{addrs: []string{"127.0.0.1:3306"}, primary: "127.0.0.1:3306"},
+		{addrs: []string{"w:127.0.0.1:3306"}, primary: "127.0.0.1:3306"},
+		{addrs: []string{"r:127.0.0.2:3306", "w:127.0.0.1:3306", "r:127.0.0.3:3306"}, primary: "127.0.0.1:3306", replicas: []string{"127.0.0.2:3306", "127.0.0.3:3306"}},
+		{addrs: []string{}, fail: true},
+		{addrs: []string{"r:127.0.0.2:3306"}, fail: true},
+		{addrs: []string{"w:127.0.0.1:3306", "w:127.0.0.2:3306"}, fail: true},
+		{addrs: []string{"w:127.0.0.1:3306", "127.0.0.2:3306"}, fail: true},
+	}
+
+	for _, c := range cases {
+		primary, replicas, err := splitAddrs(c.addrs)
+		if c.fail {
+			if err == nil {
+				t.Errorf("addrs:%v should fail", c.addrs)
+			}
+			continue
+		}
+
+		if err != nil || primary != c.primary || !reflect.DeepEqual(replicas, c.replicas) {
+			t.Errorf("addrs:%v got primary:%s replicas:%v err:%v", c.addrs, primary, replicas, err)
+		}
+	}
+
+	if _, err := parsedbSql(DB_TYPE_MYSQL, "db", []byte(`{"addrs": ["w:a:1", "r:b:1"], "balancer": "nothing"}`)); err == nil {
+		t.Errorf("unknown balancer should fail")
+	}
+}
+
+// 用dir下的sqlite文件模拟file的从库
+func addSqliteReplicas(t *testing.T, r *Router, dir string, names ...string) *dbSql {
+	dbsql := r.dbIns.get("file").(*dbSql)
+	for _, name := range names {
+		info := &dbSql{dbType: DB_TYPE_SQLITE, dbName: dbsql.dbName}
+		db, err := dial(info, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("dial replica err:%s", err)
+		}
+		dbsql.replicaAddrs = append(dbsql.replicaAddrs, name)
+		dbsql.replicas = append(dbsql.replicas, &sqlReplica{addr: name, db: db})
+	}
+
+	return dbsql
+}
+
+// 连接的sqlite文件名，内存库为空
+func dbfile(t *testing.T, db *DB) string {
+	var file string
+	if err := db.Get(&file, "SELECT file FROM pragma_database_list WHERE name='main'"); err != nil {
+		t.Fatalf("database list err:%s", err)
+	}
+
+	if file == "" {
+		return ""
+	}
+	return filepath.Base(file)
+}
+
+func TestSqlExecRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+
+	addSqliteReplicas(t, r, dir, "r1.db", "r2.db")
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		err := r.SqlExecRead(context.Background(), "ACCOUNT", func(db *DB, tables []interface{}) error {
+			got = append(got, dbfile(t, db))
+			return nil
+		}, "user11")
+		if err != nil {
+			t.Fatalf("read err:%s", err)
+		}
+	}
+
+	if !reflect.DeepEqual(got, []string{"r1.db", "r2.db", "r1.db", "r2.db"}) {
+		t.Errorf("read got:%v", got)
+	}
+
+	err = r.SqlExecWrite(context.Background(), "ACCOUNT", func(db *DB, tables []interface{}) error {
+		if f := dbfile(t, db); f != "account.db" {
+			t.Errorf("write got:%s", f)
+		}
+		return nil
+	}, "user11")
+	if err != nil {
+		t.Fatalf("write err:%s", err)
+	}
+
+	// 没有从库的instance读主库
+	err = r.SqlExecRead(context.Background(), "ACCOUNT", func(db *DB, tables []interface{}) error {
+		if f := dbfile(t, db); f != "" {
+			t.Errorf("memory read got:%s", f)
+		}
+		return nil
+	}, "user1")
+	if err != nil {
+		t.Fatalf("memory read err:%s", err)
+	}
+}
+
+func TestSqlPool(t *testing.T) {
+	cfg := []byte(`{
+		"cluster": {"ACCOUNT": [
+			{"instance": "small", "match": "full", "express": "user"},
+			{"instance": "dft", "match": "full", "express": "member"}
+		]},
+		"instances": {
+			"small": {"dbtype": "sqlite3", "dbname": "tpoolsmall", "dbcfg": {"path": ":memory:", "max_open": 4, "conn_max_lifetime": 60000}},
+			"dft": {"dbtype": "sqlite3", "dbname": "tpooldft", "dbcfg": {"path": ":memory:"}}
+		}
+	}`)
+
+	r, err := NewRouterWithOptions(cfg, Options{Strict: true})
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+	defer r.Close(context.Background())
+
+	if n := r.dbIns.get("small").(*dbSql).getDB().Stats().MaxOpenConnections; n != 4 {
+		t.Errorf("small max open:%d", n)
+	}
+
+	want := `{"instance":"small","match":"full","express":"user","pool":{"max_open":4,"max_idle":4,"conn_max_lifetime":60000,"conn_max_idle_time":0}}`
+	if info := r.RouterInfo("ACCOUNT", "user"); info != want {
+		t.Errorf("router info:%s", info)
+	}
+
+	want = `{"instance":"dft","match":"full","express":"member","pool":{"max_open":128,"max_idle":8,"conn_max_lifetime":0,"conn_max_idle_time":0}}`
+	if info := r.RouterInfo("ACCOUNT", "member"); info != want {
+		t.Errorf("router info:%s", info)
+	}
+
+	// 离线的RouteTable输出一致
+	rt, err := NewRouteTable(cfg)
+	if err != nil {
+		t.Fatalf("route table err:%s", err)
+	}
+	if info := rt.RouterInfo("ACCOUNT", "member"); info != want {
+		t.Errorf("route table info:%s", info)
+	}
+
+	for _, dbcfg := range []string{
+		`{"path": ":memory:", "max_open": 4, "max_idle": 10}`,
+		`{"path": ":memory:", "max_idle": -1}`,
+		`{"path": ":memory:", "conn_max_idle_time": "1m"}`,
+		`{"path": ":memory:", "max_idle": 0}`,
+	} {
+		issues, err := ValidateConfig([]byte(`{
+			"cluster": {"ACCOUNT": [{"instance": "bad", "match": "full", "express": "user"}]},
+			"instances": {"bad": {"dbtype": "sqlite3", "dbname": "tpoolbad", "dbcfg": ` + dbcfg + `}}
+		}`))
+		if err != nil {
+			t.Fatalf("validate err:%s", err)
+		}
+
+		found := false
+		for _, i := range issues {
+			if i.Severity == SEVERITY_ERROR && i.Path == "instances.bad.dbcfg" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("dbcfg:%s issues:%v", dbcfg, issues)
+		}
+	}
+}
+
+type poolRecorder struct {
+	maxOpen, maxIdle int
+	lifetime, idle   time.Duration
+}
+
+func (m *poolRecorder) SetMaxOpenConns(n int)              { m.maxOpen = n }
+func (m *poolRecorder) SetMaxIdleConns(n int)              { m.maxIdle = n }
+func (m *poolRecorder) SetConnMaxLifetime(d time.Duration) { m.lifetime = d }
+func (m *poolRecorder) SetConnMaxIdleTime(d time.Duration) { m.idle = d }
+
+func TestSqlPoolApply(t *testing.T) {
+	cases := []struct {
+		dbcfg string
+		want  poolRecorder
+	}{
+		{`{"addrs": ["127.0.0.1:3306"]}`, poolRecorder{maxOpen: 128, maxIdle: 8}},
+		{`{"addrs": ["127.0.0.1:3306"], "max_open": 4}`, poolRecorder{maxOpen: 4, maxIdle: 4}},
+		// max_idle为0时不保留空闲连接
+		{`{"addrs": ["127.0.0.1:3306"], "max_idle": 0}`, poolRecorder{maxOpen: 128, maxIdle: 0}},
+		{`{"addrs": ["127.0.0.1:3306"], "max_open": 0, "max_idle": 16, "conn_max_lifetime": 1000, "conn_max_idle_time": 500}`,
+			poolRecorder{maxOpen: 0, maxIdle: 16, lifetime: time.Second, idle: 500 * time.Millisecond}},
+	}
+
+	for _, c := range cases {
+		info, err := parsedbSql(DB_TYPE_MYSQL, "tpool", []byte(c.dbcfg))
+		if err != nil {
+			t.Fatalf("dbcfg:%s err:%s", c.dbcfg, err)
+		}
+
+		var got poolRecorder
+		info.pool.apply(&got)
+		if got != c.want {
+			t.Errorf("dbcfg:%s got:%+v want:%+v", c.dbcfg, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/shawnfeng/sutil/slog"
+	"github.com/shawnfeng/sutil/stime"
+)
+
+// Tx SqlTx传给查询函数的事务，Wrapper方法和DB的相同，都使用SqlTx的ctx
+type Tx struct {
+	*sqlx.Tx
+	ctx    context.Context
+	driver string
+}
+
+func (tx *Tx) NamedExecWrapper(tables []interface{}, query string, arg interface{}) (sql.Result, error) {
+	q, err := tableQuery(tx.driver, tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.Tx.NamedExecContext(tx.ctx, q, arg)
+}
+
+func (tx *Tx) SelectWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	q, err := tableQuery(tx.driver, tables, query)
+	if err != nil {
+		return err
+	}
+
+	return tx.Tx.SelectContext(tx.ctx, dest, q, args...)
+}
+
+func (tx *Tx) ExecWrapper(tables []interface{}, query string, args ...interface{}) (sql.Result, error) {
+	q, err := tableQuery(tx.driver, tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.Tx.ExecContext(tx.ctx, q, args...)
+}
+
+func (tx *Tx) QueryRowxWrapper(tables []interface{}, query string, args ...interface{}) *sqlx.Row {
+	return queryRowx(tx.ctx, tx.Tx, tx.driver, tables, query, args...)
+}
+
+func (tx *Tx) QueryxWrapper(tables []interface{}, query string, args ...interface{}) (*sqlx.Rows, error) {
+	q, err := tableQuery(tx.driver, tables, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.Tx.QueryxContext(tx.ctx, q, args...)
+}
+
+func (tx *Tx) GetWrapper(tables []interface{}, dest interface{}, query string, args ...interface{}) error {
+	q, err := tableQuery(tx.driver, tables, query)
+	if err != nil {
+		return err
+	}
+
+	return tx.Tx.GetContext(tx.ctx, dest, q, args...)
+}
+
+// SqlTx 在tables路由到的instance上开启事务执行query
+// query返回nil时提交，返回错误或者panic时回滚，panic会继续抛出
+// tables路由到不同instance时不开启事务，直接返回错误
+func (m *Router) SqlTx(ctx context.Context, cluster string, opts *sql.TxOptions, query func(*Tx, []interface{}) error, tables ...string) error {
+	if len(tables) <= 0 {
+		return fmt.Errorf("tables is empty")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := checkTables(cluster, tables); err != nil {
+		return err
+	}
+
+	stall := stime.NewTimeStat()
+	st := stime.NewTimeStat()
+
+	table := tables[0]
+	var rerr error
+	ins_name, entry, err := m.acquireInstance(func(cls *dbCluster) string {
+		var ins string
+		ins, rerr = cls.getSameInstance(cluster, tables)
+		return ins
+	})
+	if err != nil {
+		return err
+	}
+
+	if rerr != nil {
+		return rerr
+	}
+
+	durInsn := st.Duration()
+	st.Reset()
+
+	if entry == nil {
+		return fmt.Errorf("db instance not find: cluster:%s table:%s", cluster, table)
+	}
+	defer entry.release()
+	ins := entry.ins
+
+	dbsql, ok := ins.(*dbSql)
+	if !ok {
+		return fmt.Errorf("db instance type error: cluster:%s table:%s type:%s", cluster, table, ins.Type())
+	}
+
+	db := dbsql.getDB()
+	sqltx, err := db.BeginTxx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("begin tx cluster:%s table:%s instance:%s err:%s", cluster, table, ins_name, err)
+	}
+
+	durBegin := st.Duration()
+	st.Reset()
+
+	committed := false
+	defer func() {
+		if !committed {
+			if er := sqltx.Rollback(); er != nil && er != sql.ErrTxDone {
+				slog.Errorf("SqlTx rollback cluster:%s table:%s instance:%s err:%s", cluster, table, ins_name, er)
+			}
+		}
+
+		dur := st.Duration()
+		m.stat.IncQuery(cluster, table, stall.Duration())
+		slog.Tracef("[SQLTX] cls:%s table:%s nmins:%d begin:%d query:%d commit:%v", cluster, table, durInsn, durBegin, dur, committed)
+	}()
+
+	var tmptables []interface{}
+	for _, item := range tables {
+		tmptables = append(tmptables, item)
+	}
+
+	tx := &Tx{
+		Tx:     sqltx,
+		ctx:    ctx,
+		driver: db.DriverName(),
+	}
+	if err := query(tx, tmptables); err != nil {
+		return err
+	}
+
+	committed = true
+	return sqltx.Commit()
+}
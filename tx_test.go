@@ -0,0 +1,123 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSqlTx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := newSqliteRouter(t, filepath.Join(dir, "account.db"))
+	defer r.Close(context.Background())
+
+	ctx := context.Background()
+	err = r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+		for i := range tables {
+			if _, err := db.ExecWrapper(tables[i:i+1], "CREATE TABLE {{t0}} (id INTEGER PRIMARY KEY)"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, "user15", "user16")
+	if err != nil {
+		t.Fatalf("create err:%s", err)
+	}
+
+	count := func(table string) int {
+		var n int
+		err := r.SqlExec("ACCOUNT", func(db *DB, tables []interface{}) error {
+			return db.GetWrapper(tables, &n, "SELECT count(*) FROM {{t0}}")
+		}, table)
+		if err != nil {
+			t.Fatalf("count err:%s", err)
+		}
+		return n
+	}
+
+	insert := func(tx *Tx, tables []interface{}) error {
+		_, err := tx.ExecWrapper(tables, "INSERT INTO {{t0}} (id) VALUES (1)")
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecWrapper(tables, "INSERT INTO {{t1}} (id) VALUES (1)")
+		return err
+	}
+
+	// 提交
+	if err := r.SqlTx(ctx, "ACCOUNT", nil, insert, "user15", "user16"); err != nil {
+		t.Fatalf("tx commit err:%s", err)
+	}
+	if count("user15") != 1 || count("user16") != 1 {
+		t.Errorf("tx not committed")
+	}
+
+	// 出错回滚
+	err = r.SqlTx(ctx, "ACCOUNT", nil, func(tx *Tx, tables []interface{}) error {
+		if _, err := tx.ExecWrapper(tables, "INSERT INTO {{t0}} (id) VALUES (2)"); err != nil {
+			return err
+		}
+		return fmt.Errorf("abort")
+	}, "user15")
+	if err == nil || err.Error() != "abort" {
+		t.Errorf("tx err:%v", err)
+	}
+	if count("user15") != 1 {
+		t.Errorf("tx not rolled back on error")
+	}
+
+	// panic回滚，并继续抛出
+	func() {
+		defer func() {
+			if p := recover(); p == nil {
+				t.Errorf("panic not propagated")
+			}
+		}()
+
+		r.SqlTx(ctx, "ACCOUNT", nil, func(tx *Tx, tables []interface{}) error {
+			tx.ExecWrapper(tables, "INSERT INTO {{t0}} (id) VALUES (3)")
+			panic("boom")
+		}, "user15")
+	}()
+	if count("user15") != 1 {
+		t.Errorf("tx not rolled back on panic")
+	}
+
+	// 表名出错时Scan返回表名的错误，事务不受影响
+	err = r.SqlTx(ctx, "ACCOUNT", nil, func(tx *Tx, tables []interface{}) error {
+		var n int
+		bad := []interface{}{"user15; DROP TABLE user15"}
+		if err := tx.QueryRowxWrapper(bad, "SELECT count(*) FROM {{t0}}").Scan(&n); err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("bad table row scan err:%v", err)
+		}
+
+		return tx.QueryRowxWrapper(tables, "SELECT count(*) FROM {{t0}}").Scan(&n)
+	}, "user15")
+	if err != nil {
+		t.Errorf("tx row err:%s", err)
+	}
+
+	// 不同instance上的表不能在一个事务中
+	called := false
+	err = r.SqlTx(ctx, "ACCOUNT", nil, func(tx *Tx, tables []interface{}) error {
+		called = true
+		return nil
+	}, "user15", "user1")
+	if err == nil || called || !strings.Contains(err.Error(), "user15->file") || !strings.Contains(err.Error(), "user1->mem") {
+		t.Errorf("cross instance tx err:%v called:%v", err, called)
+	}
+}
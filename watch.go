@@ -0,0 +1,124 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/shawnfeng/sutil/slog"
+)
+
+// 轮询配置文件的间隔
+var fileWatchInterval = 5 * time.Second
+
+type fileWatcher struct {
+	path   string
+	notify func(error)
+
+	// 当前生效的配置，以及最近一次失败的配置，失败的配置不重复加载
+	sum    [sha1.Size]byte
+	badSum [sha1.Size]byte
+	// 最近一次读文件的错误，相同的错误只通知一次
+	readErr string
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// NewRouterFromFile 从配置文件创建Router，并定时检查文件内容的变化
+// 文件变化后通过Reload加载，新配置有问题时继续使用原来的配置
+// notify在每次加载新配置后被调用，成功时err为nil，可以为nil
+func NewRouterFromFile(path string, notify func(err error)) (*Router, error) {
+	return NewRouterFromFileWithOptions(path, Options{}, notify)
+}
+
+// NewRouterFromFileWithOptions 和NewRouterFromFile一样，首次加载和之后的Reload都使用opts
+// 新配置有任何error都不替换当前配置，Strict时没有被认领的hash桶等问题也按error处理
+func NewRouterFromFileWithOptions(path string, opts Options, notify func(err error)) (*Router, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read router config:%s err:%s", path, err)
+	}
+
+	r := newRouter()
+	r.opts = opts
+	if err := r.Reload(data); err != nil {
+		return nil, fmt.Errorf("load router config:%s err:%s", path, err)
+	}
+
+	r.watcher = &fileWatcher{
+		path:   path,
+		notify: notify,
+		sum:    sha1.Sum(data),
+		stop:   make(chan struct{}),
+	}
+
+	go r.watcher.run(r)
+	return r, nil
+}
+
+// StopWatch 停止配置文件监控，不是从文件创建的Router调用没有影响
+func (m *Router) StopWatch() {
+	if m.watcher != nil {
+		m.watcher.stopOnce.Do(func() {
+			close(m.watcher.stop)
+		})
+	}
+}
+
+func (m *fileWatcher) run(r *Router) {
+	ticker := time.NewTicker(fileWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.check(r)
+		}
+	}
+}
+
+func (m *fileWatcher) check(r *Router) {
+	fun := "fileWatcher.check -->"
+
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		if err.Error() != m.readErr {
+			m.readErr = err.Error()
+			slog.Errorf("%s read config:%s err:%s", fun, m.path, err)
+			m.report(fmt.Errorf("read router config:%s err:%s", m.path, err))
+		}
+		return
+	}
+	m.readErr = ""
+
+	sum := sha1.Sum(data)
+	if sum == m.sum || sum == m.badSum {
+		return
+	}
+
+	if err := r.Reload(data); err != nil {
+		m.badSum = sum
+		slog.Errorf("%s reload config:%s err:%s", fun, m.path, err)
+		m.report(fmt.Errorf("reload router config:%s err:%s", m.path, err))
+		return
+	}
+
+	m.sum = sum
+	slog.Infof("%s reload config:%s ok", fun, m.path)
+	m.report(nil)
+}
+
+func (m *fileWatcher) report(err error) {
+	if m.notify != nil {
+		m.notify(err)
+	}
+}
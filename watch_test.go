@@ -0,0 +1,120 @@
+// Copyright 2014 The dbrouter Author. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbrouter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRouterFromFile(t *testing.T) {
+	fileWatchInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "dbrouter")
+	if err != nil {
+		t.Fatalf("tmp dir err:%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "router.json")
+
+	cfg := func(express string) []byte {
+		return []byte(`{
+			"cluster": {"ACCOUNT": [{"instance": "account", "match": "regex", "express": "` + express + `"}]},
+			"instances": {"account": {"dbtype": "mongo", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:27017"]}}}
+		}`)
+	}
+
+	if err := ioutil.WriteFile(path, cfg("user[0-9]+"), 0644); err != nil {
+		t.Fatalf("write config err:%s", err)
+	}
+
+	if _, err := NewRouterFromFile(filepath.Join(dir, "notexist.json"), nil); err == nil {
+		t.Errorf("not exist config should fail")
+	}
+
+	notify := make(chan error, 10)
+	r, err := NewRouterFromFile(path, func(err error) { notify <- err })
+	if err != nil {
+		t.Fatalf("new router err:%s", err)
+	}
+	defer r.StopWatch()
+
+	wait := func() error {
+		select {
+		case err := <-notify:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatalf("wait reload timeout")
+		}
+		return nil
+	}
+
+	if ins := r.dbCls.getInstance("ACCOUNT", "user1"); ins != "account" {
+		t.Errorf("user1 route to:%s", ins)
+	}
+
+	// 正则错误，继续使用原来的配置
+	if err := ioutil.WriteFile(path, cfg("user[0-9"), 0644); err != nil {
+		t.Fatalf("write config err:%s", err)
+	}
+
+	if err := wait(); err == nil {
+		t.Errorf("bad config should report error")
+	}
+
+	if ins := r.RouterInfo("ACCOUNT", "user1"); ins == "{}" {
+		t.Errorf("last good config not active")
+	}
+
+	// 引用了不存在的dbtype，非Strict也不能丢掉instance后替换
+	bad := []byte(`{
+		"cluster": {"ACCOUNT": [{"instance": "account", "match": "regex", "express": "user[0-9]+"}]},
+		"instances": {"account": {"dbtype": "nosuchdb", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:27017"]}}}
+	}`)
+	if err := ioutil.WriteFile(path, bad, 0644); err != nil {
+		t.Fatalf("write config err:%s", err)
+	}
+
+	if err := wait(); err == nil {
+		t.Errorf("unknown dbtype should report error")
+	}
+
+	if ins := r.RouterInfo("ACCOUNT", "user1"); ins == "{}" {
+		t.Errorf("last good config not active after unknown dbtype")
+	}
+
+	if err := ioutil.WriteFile(path, cfg("member[0-9]+"), 0644); err != nil {
+		t.Fatalf("write config err:%s", err)
+	}
+
+	if err := wait(); err != nil {
+		t.Errorf("reload err:%s", err)
+	}
+
+	if ins := r.RouterInfo("ACCOUNT", "user1"); ins != "{}" {
+		t.Errorf("user1 still routed:%s", ins)
+	}
+
+	if ins := r.RouterInfo("ACCOUNT", "member1"); ins == "{}" {
+		t.Errorf("member1 not routed")
+	}
+
+	// Strict时没有被认领的hash桶也是error
+	hash := []byte(`{
+		"cluster": {"ACCOUNT": [{"instance": "account", "match": "hash", "express": "user", "buckets": 2, "slots": [0]}]},
+		"instances": {"account": {"dbtype": "mongo", "dbname": "taccount", "dbcfg": {"addrs": ["127.0.0.1:27017"]}}}
+	}`)
+	if err := ioutil.WriteFile(path, hash, 0644); err != nil {
+		t.Fatalf("write config err:%s", err)
+	}
+
+	if _, err := NewRouterFromFileWithOptions(path, Options{Strict: true}, nil); err == nil {
+		t.Errorf("strict load with unowned buckets should fail")
+	}
+}